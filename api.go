@@ -0,0 +1,295 @@
+package main
+
+// an optional local HTTP API so other systems (Home Assistant, scripts) can control AVRs without Ninja,
+// using the same Device methods as the Ninja channels
+//
+//	GET /avrs                    every AVR
+//	GET /avrs/{id}               one AVR and the status of its zones
+//	GET /avrs/{id}/zones/{n}     one zone's status
+//	PUT /avrs/{id}/zones/{n}     change any of power, volume (dB) or level (0-1), muted and input, e.g.
+//	                             {"power": true, "volume": -35.5, "input": "NET RADIO"}
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+)
+
+// APIConfig turns on the local HTTP API, it's off if Port is 0
+type APIConfig struct {
+	Port  int    `json:"port,string,omitempty"`
+	Token string `json:"token,omitempty"` // if set, requests need an "Authorization: Bearer <token>" header
+}
+
+// an apiAVR describes an AVR in API responses
+type apiAVR struct {
+	ID      string             `json:"id"`
+	Name    string             `json:"name"`
+	Model   string             `json:"model"`
+	IP      string             `json:"ip"`
+	Zones   int                `json:"zones"`
+	Zone    int                `json:"zone"` // the zone controlled by Ninja
+	Online  bool               `json:"online"`
+	Updated time.Time          `json:"updated,omitempty"`
+	Status  map[string]apiZone `json:"status,omitempty"` // by zone number, only for a single AVR
+}
+
+// an apiZone is a zone's status in API responses
+type apiZone struct {
+	Power        bool    `json:"power"`
+	Volume       float64 `json:"volume"` // dB
+	Level        float64 `json:"level"`  // 0-1, as used by Ninja
+	Muted        bool    `json:"muted"`
+	Input        string  `json:"input"`
+	SoundProgram string  `json:"soundProgram,omitempty"`
+}
+
+// an apiZoneChange is the body of a PUT to a zone, only the fields that are set are changed
+type apiZoneChange struct {
+	Power  *bool    `json:"power"`
+	Volume *float64 `json:"volume"`
+	Level  *float64 `json:"level"`
+	Muted  *bool    `json:"muted"`
+	Input  *string  `json:"input"`
+
+	SoundProgram *string `json:"soundProgram"` // only for zones with DSP programs
+}
+
+// apiServer serves the API until it's stopped
+type apiServer struct {
+	driver *Driver
+	token  string
+	server *http.Server
+}
+
+// startAPI starts the API if it's configured, stopping any API already running first
+// the caller holds configLock
+func (d *Driver) startAPI() error {
+	if d.api != nil {
+		// closed here (not left to the stopAPI goroutine) so the port is free for the new server
+		d.api.server.Close()
+		d.stopAPI()
+		d.api, d.stopAPI = nil, nil
+	}
+	config := d.config.API
+	if config.Port == 0 {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
+	if err != nil {
+		return fmt.Errorf("Could not start the API on port %d: %s", config.Port, err)
+	}
+	api := &apiServer{driver: d, token: config.Token}
+	api.server = &http.Server{Handler: api, ReadTimeout: requestTimeout, WriteTimeout: 2 * requestTimeout}
+	ctx, stop := context.WithCancel(d.ctx)
+	d.api, d.stopAPI = api, stop
+
+	go func() {
+		if err := api.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("API stopped: %s", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		api.server.Close()
+	}()
+	log.Infof("API listening on port %d", config.Port)
+	return nil
+}
+
+// ServeHTTP checks the token and routes each request
+func (a *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			a.error(w, http.StatusUnauthorized, "Missing or wrong token")
+			return
+		}
+	}
+
+	// /avrs, /avrs/{id} or /avrs/{id}/zones/{n}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "avrs" || len(parts) == 3 || len(parts) > 4 || len(parts) == 4 && parts[2] != "zones" {
+		a.error(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != "GET" {
+			a.error(w, http.StatusMethodNotAllowed, "Use GET")
+			return
+		}
+		a.list(w)
+		return
+	}
+
+	config, device, err := a.driver.lookupAVR(parts[1])
+	if err != nil {
+		a.error(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if len(parts) == 2 {
+		if r.Method != "GET" {
+			a.error(w, http.StatusMethodNotAllowed, "Use GET")
+			return
+		}
+		a.reply(w, http.StatusOK, a.describe(config, device, true))
+		return
+	}
+
+	zone, err := strconv.Atoi(parts[3])
+	if err != nil || zone < 1 || zone > config.Zones && zone != 1 {
+		a.error(w, http.StatusNotFound, fmt.Sprintf("AVR %s has no zone %s", config.ID, parts[3]))
+		return
+	}
+	// requests go through the AVR's queue like Ninja's, and stop if the client goes away
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	switch r.Method {
+	case "GET":
+		a.zone(ctx, w, config, device, zone)
+	case "PUT":
+		a.change(ctx, w, r, config, device, zone)
+	default:
+		a.error(w, http.StatusMethodNotAllowed, "Use GET or PUT")
+	}
+}
+
+func (a *apiServer) list(w http.ResponseWriter) {
+	a.driver.configLock.Lock()
+	avrs := []apiAVR{}
+	for id, config := range a.driver.config.AVRs {
+		if device, ok := a.driver.devices[id]; ok {
+			avrs = append(avrs, a.describe(config, device, false))
+		}
+	}
+	a.driver.configLock.Unlock()
+	a.reply(w, http.StatusOK, avrs)
+}
+
+// describe makes an AVR's API description, with its zones' cached status if withStatus is set
+func (a *apiServer) describe(config *AVRConfig, device *Device, withStatus bool) apiAVR {
+	offline, _ := device.health.Offline()
+	avr := apiAVR{
+		ID:      config.ID,
+		Name:    config.Name,
+		Model:   config.Model,
+		IP:      config.IP,
+		Zones:   config.Zones,
+		Zone:    config.Zone,
+		Online:  !offline,
+		Updated: device.status.Updated(),
+	}
+	if withStatus {
+		avr.Status = make(map[string]apiZone)
+		for zone := 1; zone <= config.Zones || zone == 1; zone++ {
+			if status, ok := device.status.Zone(zone); ok {
+				avr.Status[strconv.Itoa(zone)] = makeAPIZone(config, status)
+			}
+		}
+	}
+	return avr
+}
+
+func makeAPIZone(config *AVRConfig, status ync.ZoneStatus) apiZone {
+	return apiZone{
+		Power:        status.Power,
+		Volume:       status.Volume,
+		Level:        volumeLevel(config, status.Volume),
+		Muted:        status.Muted,
+		Input:        status.Input,
+		SoundProgram: status.SoundProgram,
+	}
+}
+
+// zone replies with a zone's status from the cache, or from the AVR if it hasn't been read yet
+func (a *apiServer) zone(ctx context.Context, w http.ResponseWriter, config *AVRConfig, device *Device, zone int) {
+	status, ok := device.status.Zone(zone)
+	if !ok {
+		var err error
+		if status, err = device.client.ReadStatus(ctx, zone); err != nil {
+			a.error(w, http.StatusBadGateway, fmt.Sprintf("Could not read zone %d: %s", zone, err))
+			return
+		}
+	}
+	a.reply(w, http.StatusOK, makeAPIZone(config, status))
+}
+
+// change applies a PUT to a zone with the same Device methods as the Ninja channels (so the change is
+// confirmed and, for the selected zone, published to Ninja), then replies with the zone's status
+func (a *apiServer) change(ctx context.Context, w http.ResponseWriter, r *http.Request, config *AVRConfig, device *Device, zone int) {
+	var change apiZoneChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		a.error(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+		return
+	}
+	if change.Volume != nil && change.Level != nil {
+		a.error(w, http.StatusBadRequest, "Set volume or level, not both")
+		return
+	}
+	if change.Volume != nil {
+		if err := ync.CheckVolume(*change.Volume, config.MaxVolume); err != nil {
+			a.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if change.Input != nil {
+		if err := ync.CheckInput(config.Name, *change.Input, config.Capabilities.inputs()); err != nil {
+			a.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if change.SoundProgram != nil {
+		err := ync.CheckSoundProgram(config.Name, zone, *change.SoundProgram, config.Capabilities.hasSoundPrograms(zone))
+		if err != nil {
+			a.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// power first, as a zone that's off ignores the rest
+	var err error
+	if change.Power != nil {
+		err = device.switchPower(ctx, *change.Power, zone)
+	}
+	if err == nil && change.Input != nil {
+		err = device.setInput(ctx, *change.Input, zone)
+	}
+	if err == nil && change.SoundProgram != nil {
+		err = device.setSoundProgram(ctx, *change.SoundProgram, zone)
+	}
+	if err == nil && change.Volume != nil {
+		err = device.setVolume(ctx, ync.ConformToClosest(*change.Volume, 0.5), zone)
+	}
+	if err == nil && change.Level != nil {
+		_, err = device.setVolumeLevel(ctx, *change.Level, zone)
+	}
+	if err == nil && change.Muted != nil {
+		err = device.setMuted(ctx, *change.Muted, zone)
+	}
+	if err != nil {
+		a.error(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	a.zone(ctx, w, config, device, zone)
+}
+
+func (a *apiServer) reply(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Warningf("Could not send API response: %s", err)
+	}
+}
+
+func (a *apiServer) error(w http.ResponseWriter, code int, message string) {
+	a.reply(w, code, map[string]string{"error": message})
+}
@@ -0,0 +1,287 @@
+package main
+
+// browsing of the menu-based inputs (NET RADIO, SERVER, USB) using YNC List_Info/List_Control
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// browseInputs maps the input names used by the driver to the YNC elements that support list browsing
+var browseInputs = map[string]string{
+	"NET RADIO": "NET_RADIO",
+	"SERVER":    "SERVER",
+	"USB":       "USB",
+}
+
+// linesPerPage is the number of lines the AVR returns for each page of a list
+const linesPerPage = 8
+
+// how long to wait for the AVR to finish loading a menu level before giving up
+const (
+	listReadyTimeout = 10 * time.Second
+	listPollInterval = 250 * time.Millisecond
+)
+
+// a ListLine is one entry in the current menu, Attribute is "Container", "Item" or "Unselectable"
+type ListLine struct {
+	Text      string `xml:"Txt"`
+	Attribute string `xml:"Attribute"`
+}
+
+// ListInfo is the state of the AVR's menu for a browsable input
+type ListInfo struct {
+	Status   string `xml:"Menu_Status"` // "Ready" or "Busy"
+	Layer    int    `xml:"Menu_Layer"`
+	MenuName string `xml:"Menu_Name"`
+	List     struct {
+		Lines []ListLine `xml:",any"` // Line_1 ... Line_8
+	} `xml:"Current_List"`
+	Cursor struct {
+		CurrentLine int `xml:"Current_Line"`
+		MaxLine     int `xml:"Max_Line"`
+	} `xml:"Cursor_Position"`
+}
+
+// PageStart returns the absolute line number of the first line on the current page
+func (l *ListInfo) PageStart() int {
+	if l.Cursor.CurrentLine < 1 {
+		return 1
+	}
+	return ((l.Cursor.CurrentLine-1)/linesPerPage)*linesPerPage + 1
+}
+
+// listInfo reads the current menu level for a browsable input
+func (c *client) listInfo(ctx context.Context, input string) (*ListInfo, error) {
+	element, ok := browseInputs[input]
+	if !ok {
+		return nil, fmt.Errorf("input %s can't be browsed", input)
+	}
+	data, err := c.Request(ctx, "GET", "<"+element+"><List_Info>GetParam</List_Info></"+element+">")
+	if err != nil {
+		return nil, err
+	}
+	var rsp struct {
+		Input struct {
+			Info ListInfo `xml:"List_Info"`
+		} `xml:",any"`
+	}
+	if err := xml.Unmarshal(data, &rsp); err != nil {
+		return nil, err
+	}
+	// drop blank lines at the end of the last page
+	info := rsp.Input.Info
+	for len(info.List.Lines) > 0 && info.List.Lines[len(info.List.Lines)-1].Text == "" {
+		info.List.Lines = info.List.Lines[:len(info.List.Lines)-1]
+	}
+	return &info, nil
+}
+
+// listControl sends a List_Control command (e.g. <Cursor>Back</Cursor>) for a browsable input
+func (c *client) listControl(ctx context.Context, input, command string) error {
+	element, ok := browseInputs[input]
+	if !ok {
+		return fmt.Errorf("input %s can't be browsed", input)
+	}
+	_, err := c.Request(ctx, "PUT", "<"+element+"><List_Control>"+command+"</List_Control></"+element+">")
+	return err
+}
+
+// listSelect selects a line (1-8) on the current page, entering a container or playing an item
+func (c *client) listSelect(ctx context.Context, input string, line int) error {
+	return c.listControl(ctx, input, "<Direct_Sel>Line_"+strconv.Itoa(line)+"</Direct_Sel>")
+}
+
+// listBack goes up one menu level
+func (c *client) listBack(ctx context.Context, input string) error {
+	return c.listControl(ctx, input, "<Cursor>Back</Cursor>")
+}
+
+// listHome returns to the top menu level
+func (c *client) listHome(ctx context.Context, input string) error {
+	return c.listControl(ctx, input, "<Cursor>Return to Home</Cursor>")
+}
+
+// listPage moves one page up or down in the current menu level
+func (c *client) listPage(ctx context.Context, input string, up bool) error {
+	direction := "Down"
+	if up {
+		direction = "Up"
+	}
+	return c.listControl(ctx, input, "<Page>"+direction+"</Page>")
+}
+
+// listJump moves the cursor to an absolute line in the current menu level
+func (c *client) listJump(ctx context.Context, input string, line int) error {
+	return c.listControl(ctx, input, "<Jump_Line>"+strconv.Itoa(line)+"</Jump_Line>")
+}
+
+// waitListReady polls the menu until the AVR has finished loading it
+func (c *client) waitListReady(ctx context.Context, input string) (*ListInfo, error) {
+	deadline := time.Now().Add(listReadyTimeout)
+	for {
+		info, err := c.listInfo(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		if info.Status == "Ready" {
+			return info, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s menu not ready after %v", input, listReadyTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(listPollInterval):
+		}
+	}
+}
+
+// playPath navigates from the top menu level through each named entry in path and selects the last one
+func (c *client) playPath(ctx context.Context, input string, path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("empty %s path", input)
+	}
+	if err := c.listHome(ctx, input); err != nil {
+		return err
+	}
+	for _, name := range path {
+		info, err := c.waitListReady(ctx, input)
+		if err != nil {
+			return err
+		}
+		line, err := c.findLine(ctx, input, info, name)
+		if err != nil {
+			return err
+		}
+		if err := c.listSelect(ctx, input, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findLine pages through the current menu level looking for an entry called name
+// and returns its line number on the (now current) page
+func (c *client) findLine(ctx context.Context, input string, info *ListInfo, name string) (int, error) {
+	// start from the top of the list so every page is checked
+	if info.PageStart() != 1 {
+		if err := c.listJump(ctx, input, 1); err != nil {
+			return 0, err
+		}
+	}
+	for start := 1; start <= info.Cursor.MaxLine; start += linesPerPage {
+		if start != 1 {
+			if err := c.listJump(ctx, input, start); err != nil {
+				return 0, err
+			}
+		}
+		page, err := c.waitListReady(ctx, input)
+		if err != nil {
+			return 0, err
+		}
+		for i, line := range page.List.Lines {
+			if line.Text == name {
+				return i + 1, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("could not find %q in %s menu %q", name, input, info.MenuName)
+}
+
+// a browseState is where a device's menus have been browsed to, so the last item played can be bookmarked
+// each input has its own menus (and the AVR remembers where each one is), so paths are kept by input
+// paths are always copied in and out, so nothing shares a slice with a saved favourite
+// config screens and the favourites service use it without configLock, so it has its own lock
+type browseState struct {
+	lock        sync.Mutex
+	paths       map[string][]string // containers entered to reach each input's current menu level
+	playedInput string              // the input the last item was played on
+	played      []string            // full path of the last item played
+}
+
+// path returns the containers entered to reach input's current menu level
+func (b *browseState) path(input string) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.get(input)
+}
+
+// get and set are path and replacing it, the caller holds lock
+func (b *browseState) get(input string) []string {
+	return append([]string(nil), b.paths[input]...)
+}
+
+func (b *browseState) set(input string, path []string) {
+	if b.paths == nil {
+		b.paths = make(map[string][]string)
+	}
+	b.paths[input] = append([]string(nil), path...)
+}
+
+// enter records a container being opened
+func (b *browseState) enter(input, name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.set(input, append(b.get(input), name))
+}
+
+// leave records going back up a level
+func (b *browseState) leave(input string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if path := b.get(input); len(path) > 0 {
+		b.set(input, path[:len(path)-1])
+	}
+}
+
+// home records going back to the top menu
+func (b *browseState) home(input string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.set(input, nil)
+}
+
+// trim forgets containers deeper than the AVR's menu layer, as it can be browsed with the remote too
+func (b *browseState) trim(input string, layer int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if path := b.get(input); layer > 0 && len(path) > layer-1 {
+		b.set(input, path[:layer-1])
+	}
+}
+
+// play records an item in input's current menu being played
+func (b *browseState) play(input, name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.playedInput = input
+	b.played = append(b.get(input), name)
+}
+
+// replay records a favourite's path being played, which leaves input's menu where the item is
+func (b *browseState) replay(input string, path []string) {
+	if len(path) == 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.set(input, path[:len(path)-1])
+	b.playedInput = input
+	b.played = append([]string(nil), path...)
+}
+
+// playedPath returns the path of the last item played if it was played on input (nil otherwise)
+func (b *browseState) playedPath(input string) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.playedInput != input {
+		return nil
+	}
+	return append([]string(nil), b.played...)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBrowseStateCopiesPaths(t *testing.T) {
+	var browsing browseState
+	favourite := Favourite{Name: "Jazz", Input: "NET RADIO", Path: []string{"Bookmarks", "Jazz", "WBGO"}}
+	browsing.replay(favourite.Input, favourite.Path)
+	browsing.enter("NET RADIO", "Other")
+	browsing.play("NET RADIO", "KCSM")
+
+	if want := []string{"Bookmarks", "Jazz", "WBGO"}; !reflect.DeepEqual(favourite.Path, want) {
+		t.Errorf("browsing changed the favourite's path to %v", favourite.Path)
+	}
+	played := browsing.playedPath("NET RADIO")
+	if want := []string{"Bookmarks", "Jazz", "Other", "KCSM"}; !reflect.DeepEqual(played, want) {
+		t.Errorf("playedPath = %v, want %v", played, want)
+	}
+	played[0] = "Changed"
+	if browsing.playedPath("NET RADIO")[0] != "Bookmarks" {
+		t.Error("changing a returned path changed the browse state")
+	}
+}
+
+func TestBrowseStatePlayedPathByInput(t *testing.T) {
+	var browsing browseState
+	browsing.enter("SERVER", "Music")
+	browsing.play("SERVER", "Track 1")
+	browsing.enter("NET RADIO", "Bookmarks")
+
+	if played := browsing.playedPath("NET RADIO"); played != nil {
+		t.Errorf("playedPath(NET RADIO) = %v after playing on SERVER, want nil", played)
+	}
+	if path := browsing.path("SERVER"); !reflect.DeepEqual(path, []string{"Music"}) {
+		t.Errorf("SERVER path = %v after browsing NET RADIO, want [Music]", path)
+	}
+	browsing.trim("SERVER", 1)
+	if path := browsing.path("SERVER"); len(path) != 0 {
+		t.Errorf("SERVER path = %v after trimming to the top menu, want none", path)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+)
+
+// Capabilities describe what an AVR model has, read from its System Config (Feature_Existence), main zone
+// status and input list and Tuner Config when it's saved, so screens only show controls the AVR supports
+// NOTE: HDMI outputs aren't detected as the driver has no controls for them (yet)
+type Capabilities struct {
+	Detected      bool     `json:"detected,string,omitempty"`      // false if the AVR doesn't list its features - everything is shown
+	Features      []string `json:"features,omitempty"`             // Feature_Existence elements the AVR has (Main_Zone, Zone_2, Tuner, NET_RADIO, USB etc.)
+	Inputs        []string `json:"inputs,omitempty"`               // inputs that can be selected, as the AVR names them
+	SoundPrograms bool     `json:"soundPrograms,string,omitempty"` // the main zone has DSP programs (its status includes one)
+	TunerBands    []string `json:"tunerBands,omitempty"`           // bands the tuner can receive (FM, AM, DAB etc.), none without a tuner
+	Firmware      string   `json:"firmware,omitempty"`             // the firmware version when they were detected
+}
+
+// errNoFeatures is returned for AVRs that don't list their features, which asking again won't change
+var errNoFeatures = errors.New("AVR doesn't list its features")
+
+// detectCapabilities asks the AVR what it has, an AVR that can't say returns an undetected Capabilities
+// and errNoFeatures, any other error means it couldn't be asked (and the result is undetected too),
+// so a model is never recorded as missing something because a request failed
+func detectCapabilities(ctx context.Context, c *client, config *AVRConfig) (Capabilities, error) {
+	system, err := c.SystemConfig(ctx)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	if len(system.Features) == 0 {
+		return Capabilities{Firmware: system.Firmware}, errNoFeatures
+	}
+	capabilities := Capabilities{Detected: true, Firmware: system.Firmware}
+	for feature, exists := range system.Features {
+		if exists {
+			capabilities.Features = append(capabilities.Features, feature)
+		}
+	}
+	sort.Strings(capabilities.Features)
+
+	// without the input list every input is offered, as before
+	inputs, err := c.InputNames(ctx, 1)
+	if err != nil {
+		logFor(config).op("detectCapabilities").with("error", err).Warningf("Could not read inputs, showing them all")
+	}
+	capabilities.Inputs = inputs
+
+	status, err := c.ZoneStatus(ctx, 1)
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("Could not read the main zone for DSP programs: %s", err)
+	}
+	capabilities.SoundPrograms = ync.HasSoundPrograms(1, status)
+
+	if capabilities.has("Tuner") {
+		bands, err := c.TunerBands(ctx)
+		if err != nil {
+			return Capabilities{}, fmt.Errorf("Could not read tuner bands: %s", err)
+		}
+		capabilities.TunerBands = bands
+	}
+	return capabilities, nil
+}
+
+// has returns whether the AVR has a feature (a Feature_Existence element name),
+// everything is assumed to exist when capabilities weren't detected
+func (c *Capabilities) has(feature string) bool {
+	if !c.Detected {
+		return true
+	}
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// zones returns how many zones the AVR has (main zone first, then Zone_2 etc.), 0 if unknown
+func (c *Capabilities) zones() int {
+	if !c.Detected {
+		return 0
+	}
+	features := make(map[string]bool)
+	for _, feature := range c.Features {
+		features[feature] = true
+	}
+	return ync.Zones(features)
+}
+
+// inputs returns the inputs that can be selected on the AVR
+func (c *Capabilities) inputs() []string {
+	if len(c.Inputs) == 0 {
+		return ync.DefaultInputs
+	}
+	return c.Inputs
+}
+
+// hasInput returns whether input can be selected on the AVR
+func (c *Capabilities) hasInput(input string) bool {
+	for _, i := range c.inputs() {
+		if i == input {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSoundPrograms returns whether a zone's DSP program can be selected, only the main zone has them
+func (c *Capabilities) hasSoundPrograms(zone int) bool {
+	return zone <= 1 && (c.SoundPrograms || !c.Detected)
+}
+
+// tunerBands returns the bands the AVR's tuner can be switched to, FM and AM if they weren't detected
+func (c *Capabilities) tunerBands() []string {
+	if !c.Detected {
+		return []string{"FM", "AM"}
+	}
+	return c.TunerBands
+}
+
+// hasTunerBand returns whether the AVR's tuner can be switched to band
+func (c *Capabilities) hasTunerBand(band string) bool {
+	for _, b := range c.tunerBands() {
+		if b == band {
+			return true
+		}
+	}
+	return false
+}
+
+// canBrowse returns whether input is a menu-based input the AVR has
+func (c *Capabilities) canBrowse(input string) bool {
+	element, ok := browseInputs[input]
+	return ok && c.has(element) && c.hasInput(input)
+}
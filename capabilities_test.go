@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync/ynctest"
+)
+
+// detect runs detectCapabilities against a fake AVR
+func detect(t *testing.T, avr *ynctest.Server) Capabilities {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newClient(avr.IP(), time.Second)
+	go client.Run(ctx)
+	capabilities, err := detectCapabilities(ctx, client, &AVRConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return capabilities
+}
+
+func TestDetectCapabilities(t *testing.T) {
+	avr := ynctest.NewServer()
+	defer avr.Close()
+
+	capabilities := detect(t, avr)
+	if !capabilities.SoundPrograms || !capabilities.hasSoundPrograms(1) {
+		t.Errorf("SoundPrograms = false for an AVR whose main zone has a DSP program")
+	}
+	if capabilities.hasSoundPrograms(2) {
+		t.Errorf("hasSoundPrograms(2) = true, only the main zone has DSP programs")
+	}
+	if want := []string{"FM", "AM"}; !reflect.DeepEqual(capabilities.TunerBands, want) {
+		t.Errorf("TunerBands = %v, want %v", capabilities.TunerBands, want)
+	}
+	if !capabilities.hasTunerBand("AM") || capabilities.hasTunerBand("DAB") {
+		t.Errorf("hasTunerBand doesn't match TunerBands %v", capabilities.TunerBands)
+	}
+}
+
+func TestDetectCapabilitiesWithoutDSPOrTuner(t *testing.T) {
+	avr := ynctest.NewServer()
+	defer avr.Close()
+	avr.SetFeatures("NET_RADIO", "USB")
+	avr.SetZone(1, ynctest.Zone{Volume: -40, Input: "HDMI1"})
+
+	capabilities := detect(t, avr)
+	if capabilities.SoundPrograms || capabilities.hasSoundPrograms(1) {
+		t.Errorf("SoundPrograms = true for an AVR without a DSP program")
+	}
+	if len(capabilities.TunerBands) > 0 || len(capabilities.tunerBands()) > 0 {
+		t.Errorf("TunerBands = %v for an AVR without a tuner", capabilities.TunerBands)
+	}
+}
+
+func TestUndetectedCapabilitiesShowEverything(t *testing.T) {
+	var capabilities Capabilities
+	if !capabilities.hasSoundPrograms(1) || capabilities.hasSoundPrograms(2) {
+		t.Errorf("undetected AVRs should offer DSP programs for the main zone only")
+	}
+	if !capabilities.hasTunerBand("FM") || !capabilities.hasTunerBand("AM") {
+		t.Errorf("undetected AVRs should offer FM and AM, got %v", capabilities.tunerBands())
+	}
+}
+
+func TestDetectCapabilitiesFailedReads(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tests := []struct {
+		name  string
+		setup func(avr *ynctest.Server)
+	}{
+		{"main zone", func(avr *ynctest.Server) { avr.Fail(1, true) }},
+		{"tuner bands", func(avr *ynctest.Server) { avr.SetTunerBands() }},
+	}
+	for _, test := range tests {
+		avr := ynctest.NewServer()
+		test.setup(avr)
+		client := newClient(avr.IP(), time.Second)
+		go client.Run(ctx)
+		// a read that fails isn't a capability the model lacks, so nothing is detected
+		capabilities, err := detectCapabilities(ctx, client, &AVRConfig{})
+		if err == nil || err == errNoFeatures || capabilities.Detected {
+			t.Errorf("%s failing: detectCapabilities = %+v, %v, want undetected and an error", test.name, capabilities, err)
+		}
+		avr.Close()
+	}
+
+	avr := ynctest.NewServer()
+	defer avr.Close()
+	avr.SetFeatures()
+	client := newClient(avr.IP(), time.Second)
+	go client.Run(ctx)
+	if capabilities, err := detectCapabilities(ctx, client, &AVRConfig{}); err != errNoFeatures || capabilities.Detected || capabilities.Firmware == "" {
+		t.Errorf("without features: detectCapabilities = %+v, %v, want undetected with firmware and errNoFeatures", capabilities, err)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"time"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+)
+
+// a client is a ync.Client with the requests only the driver needs (browsing, favourites, events) added
+type client struct {
+	*ync.Client
+}
+
+// newClient makes a client for the AVR at ip, it needs Run before it can be used
+func newClient(ip string, timeout time.Duration) *client {
+	return &client{ync.NewClient(ip, timeout)}
+}
@@ -0,0 +1,337 @@
+// avr-yamaha controls Yamaha AV Receivers from the command line, using the same YNC client and checks as the
+// Ninja Sphere driver, so the driver's requests can be tried out (and debugged) on any computer
+// fake starts a fake AVR (ynctest) to try it, or the driver, without one
+//
+//	avr-yamaha discover
+//	avr-yamaha -ip 192.168.1.20 status
+//	avr-yamaha -ip 192.168.1.20 -zone 2 power on
+//	avr-yamaha -ip 192.168.1.20 volume -35.5
+//	avr-yamaha -ip 192.168.1.20 volume up 2
+//	avr-yamaha -ip 192.168.1.20 tail
+//	avr-yamaha fake
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync/ynctest"
+	"github.com/lindsaymarkward/go-avr-yamaha"
+)
+
+var (
+	ip        = flag.String("ip", "", "IP address of the AVR")
+	zone      = flag.Int("zone", 1, "zone to control (1 is the main zone)")
+	timeout   = flag.Duration("timeout", ync.DefaultTimeout, "how long to wait for each request")
+	maxVolume = flag.Float64("max", avryamaha.MaxVolume, "highest volume (dB) a volume command can set, like the driver's Max Volume")
+	wait      = flag.Duration("wait", 3*time.Second, "how long discover waits for AVRs to answer")
+	interval  = flag.Duration("interval", 2*time.Second, "how often tail reads the AVR")
+)
+
+const usage = `Usage: avr-yamaha [flags] command [arguments]
+
+Commands:
+  discover                 find AVRs on the network
+  status                   show the AVR's details and the status of every zone
+  power on|off|toggle      turn the zone on or off
+  volume DB                set the zone's volume (dB, e.g. -35.5, up to -max)
+  volume up|down DB        change the zone's volume by DB
+  mute on|off|toggle       mute or unmute the zone
+  input NAME               select the zone's input, one the AVR lists (e.g. "NET RADIO", HDMI1)
+  dsp PROGRAM              select the main zone's DSP program (e.g. Standard, "7ch Stereo")
+  tail                     show changes to every zone until interrupted
+  fake                     run a fake AVR (for -ip) until interrupted
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// go-avr-yamaha uses the default client and can't be cancelled (see ync.Client)
+	http.DefaultClient.Timeout = 30 * time.Second
+
+	// Ctrl-C stops whatever is running (tail runs until it's pressed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "discover":
+		if err := discover(ctx); err != nil {
+			fail("Discovery failed: %s", err)
+		}
+		return
+	case "fake":
+		fake(ctx)
+		return
+	}
+	if err := ync.CheckMaxVolume(*maxVolume); err != nil {
+		fail("Invalid -max: %s", err)
+	}
+
+	if *ip == "" {
+		fail("Please give the AVR's address with -ip (try discover to find it)")
+	}
+	avr := &avryamaha.AVR{IP: *ip}
+	client := ync.NewUnqueuedClient(avr, *timeout)
+
+	var err error
+	switch command {
+	case "status":
+		err = status(ctx, client, avr)
+	case "power":
+		err = onOff(args, func(on bool) error { return client.SetPower(ctx, on, *zone) },
+			func() (bool, error) { return client.TogglePower(ctx, *zone) })
+	case "mute":
+		err = onOff(args, func(on bool) error { return client.SetMuted(ctx, on, *zone) },
+			func() (bool, error) { return client.ToggleMuted(ctx, *zone) })
+	case "volume":
+		err = volume(ctx, client, args)
+	case "input":
+		if len(args) != 1 {
+			fail("Please give one input name (quote names with spaces)")
+		}
+		if err = ync.CheckInput(*ip, args[0], inputs(ctx, client)); err == nil {
+			err = client.SetInput(ctx, args[0], *zone)
+		}
+	case "dsp":
+		if len(args) != 1 {
+			fail("Please give one DSP program name (quote names with spaces)")
+		}
+		var programs bool
+		if programs, err = hasSoundPrograms(ctx, client, *zone); err == nil {
+			err = ync.CheckSoundProgram(*ip, *zone, args[0], programs)
+		}
+		if err == nil {
+			err = client.SetSoundProgram(ctx, args[0], *zone)
+		}
+	case "tail":
+		err = tail(ctx, client)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail("%s failed: %s", command, err)
+	}
+
+	// show what the command did
+	switch command {
+	case "power", "mute", "volume", "input", "dsp":
+		zoneStatus, err := client.ReadStatus(ctx, *zone)
+		if err != nil {
+			fail("Could not read zone %d back: %s", *zone, err)
+		}
+		fmt.Println(describeZone(*zone, zoneStatus))
+	}
+}
+
+// fail prints an error and exits
+func fail(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
+
+func discover(ctx context.Context) error {
+	receivers, err := ync.Discover(ctx, *wait)
+	if err != nil {
+		return err
+	}
+	if len(receivers) == 0 {
+		fmt.Println("No AVRs found")
+		return nil
+	}
+	sort.Slice(receivers, func(i, j int) bool { return receivers[i].IP < receivers[j].IP })
+	for _, receiver := range receivers {
+		fmt.Printf("%-15s  %-12s  %s\n", receiver.IP, receiver.Model, receiver.Name)
+	}
+	return nil
+}
+
+func status(ctx context.Context, client *ync.Client, avr *avryamaha.AVR) error {
+	if err := client.GetXMLData(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("%s (serial number %s) at %s\n", avr.Model, avr.ID, avr.IP)
+	if system, err := client.SystemConfig(ctx); err == nil && system.Firmware != "" {
+		fmt.Println("Firmware:", system.Firmware)
+	}
+
+	if features, err := client.Features(ctx); err == nil {
+		var names []string
+		for name, exists := range features {
+			if exists {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		fmt.Println("Features:", strings.Join(names, ", "))
+	}
+	if inputs, err := client.InputNames(ctx, 1); err == nil {
+		fmt.Println("Inputs:", strings.Join(inputs, ", "))
+	}
+
+	for z, count := 1, client.Zones(ctx); z <= count; z++ {
+		zoneStatus, err := client.ReadStatus(ctx, z)
+		if err != nil {
+			return fmt.Errorf("Zone %d: %s", z, err)
+		}
+		fmt.Println(describeZone(z, zoneStatus))
+	}
+	return nil
+}
+
+// inputs returns the inputs the AVR lists for the main zone, or the ones the driver offers if it can't,
+// as only the main zone's are detected by the driver
+func inputs(ctx context.Context, client *ync.Client) []string {
+	names, err := client.InputNames(ctx, 1)
+	if err != nil || len(names) == 0 {
+		return ync.DefaultInputs
+	}
+	return names
+}
+
+// hasSoundPrograms returns whether a zone has DSP programs, detected as the driver does,
+// the main zone of an AVR that doesn't list its features is assumed to have them
+func hasSoundPrograms(ctx context.Context, client *ync.Client, zone int) (bool, error) {
+	system, err := client.SystemConfig(ctx)
+	if err != nil {
+		return false, err
+	}
+	if len(system.Features) == 0 {
+		return zone <= 1, nil
+	}
+	mainZone, err := client.ZoneStatus(ctx, 1)
+	if err != nil {
+		return false, fmt.Errorf("Could not read the main zone for DSP programs: %s", err)
+	}
+	return ync.HasSoundPrograms(zone, mainZone), nil
+}
+
+// fake runs a fake AVR until ctx is done, printing the address to give -ip (or the driver)
+func fake(ctx context.Context) {
+	avr := ynctest.NewServer()
+	defer avr.Close()
+	fmt.Printf("Fake AVR at %s, press Ctrl-C to stop it\n", avr.IP())
+	fmt.Printf("Try: avr-yamaha -ip %s status\n", avr.IP())
+	<-ctx.Done()
+}
+
+// describeZone is one line describing a zone's status
+func describeZone(zone int, status ync.ZoneStatus) string {
+	power := "off"
+	if status.Power {
+		power = "on"
+	}
+	description := fmt.Sprintf("Zone %d (%s): %s, %.1f dB", zone, ync.ZoneElement(zone), power, status.Volume)
+	if status.Muted {
+		description += " (muted)"
+	}
+	description += ", input " + status.Input
+	if status.SoundProgram != "" {
+		description += ", DSP " + status.SoundProgram
+	}
+	return description
+}
+
+// onOff runs set for "on" or "off", or toggle for "toggle"
+func onOff(args []string, set func(on bool) error, toggle func() (bool, error)) error {
+	if len(args) != 1 {
+		fail("Please give on, off or toggle")
+	}
+	switch args[0] {
+	case "on", "off":
+		return set(args[0] == "on")
+	case "toggle":
+		_, err := toggle()
+		return err
+	}
+	fail("Please give on, off or toggle, not %q", args[0])
+	return nil
+}
+
+// volume sets an absolute volume ("-35.5") or changes it ("up 2", "down 2.5")
+func volume(ctx context.Context, client *ync.Client, args []string) error {
+	direction := ""
+	if len(args) == 2 && (args[0] == "up" || args[0] == "down") {
+		direction, args = args[0], args[1:]
+	}
+	if len(args) != 1 {
+		fail("Please give a volume in dB, or up or down and a change in dB")
+	}
+	dB, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		fail("Invalid volume %q: %s", args[0], err)
+	}
+	switch direction {
+	case "up":
+		_, err = client.ChangeVolume(ctx, dB, *maxVolume, *zone)
+		return err
+	case "down":
+		_, err = client.ChangeVolume(ctx, -dB, *maxVolume, *zone)
+		return err
+	}
+	if err := ync.CheckVolume(dB, *maxVolume); err != nil {
+		fail("%s", err)
+	}
+	return client.SetVolume(ctx, int(ync.ConformToClosest(dB, 0.5)*10), *zone)
+}
+
+// tail reads every zone each interval and prints the ones that changed, until ctx is done
+func tail(ctx context.Context, client *ync.Client) error {
+	count := client.Zones(ctx)
+	last := make(map[int]ync.ZoneStatus)
+	var lastErr error
+	for {
+		for z := 1; z <= count; z++ {
+			zoneStatus, err := client.ZoneStatus(ctx, z)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				if lastErr == nil {
+					fmt.Printf("%s  unreachable: %s\n", time.Now().Format("15:04:05"), err)
+				}
+				lastErr = err
+				break
+			}
+			if lastErr != nil {
+				fmt.Printf("%s  reachable again\n", time.Now().Format("15:04:05"))
+				lastErr = nil
+			}
+			if previous, ok := last[z]; !ok || previous != zoneStatus {
+				fmt.Printf("%s  %s\n", time.Now().Format("15:04:05"), describeZone(z, zoneStatus))
+				last[z] = zoneStatus
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
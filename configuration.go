@@ -1,19 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"runtime/debug"
 
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
 	"github.com/lindsaymarkward/go-avr-yamaha"
 	"github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/go-ninja/suit"
 )
 
 // TODO: idea: make an option to force a particular input on ON/Play, or double-tap to cycle inputs (?)
-// TODO: make desired inputs a config item? (ideally, get from device, but doesn't seem possible?)
-var inputs = []string{"NET RADIO", "TUNER", "AUDIO1", "AUDIO2", "V-AUX", "USB", "DOCK", "PC"}
 
 type configService struct {
 	driver *Driver
@@ -31,133 +34,401 @@ func (c *configService) GetActions(request *model.ConfigurationRequest) (*[]suit
 }
 
 // Configure is the handler for all configuration screen requests
-func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+// a panic while handling a request (e.g. a bug with an unexpected request) shows the error screen
+// rather than taking down the whole driver
+func (c *configService) Configure(request *model.ConfigurationRequest) (screen *suit.ConfigurationScreen, err error) {
 	log.Infof("Incoming configuration request. Action:%s Data:%s", request.Action, string(request.Data))
 
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Panic handling configuration request. Action:%s Data:%s - %v\n%s", request.Action, string(request.Data), r, debug.Stack())
+			screen, err = c.error(fmt.Sprintf("Something went wrong with %q: %v", request.Action, r))
+		}
+	}()
+
+	// every AVR request made for this screen stops when it's taking too long or the driver stops
+	ctx, cancel := context.WithTimeout(c.driver.ctx, requestTimeout)
+	defer cancel()
+
+	return c.configure(ctx, request)
+}
+
+// locked shows a screen that reads the config, holding configLock
+func (c *configService) locked(screen func() (*suit.ConfigurationScreen, error)) (*suit.ConfigurationScreen, error) {
+	c.driver.configLock.Lock()
+	defer c.driver.configLock.Unlock()
+	return screen()
+}
+
+// change changes the config holding configLock, then returns a fresh copy of the AVR's config for the next screen
+func (c *configService) change(id string, change func() error) (*AVRConfig, error) {
+	c.driver.configLock.Lock()
+	err := change()
+	c.driver.configLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	avr, _, err := c.driver.lookupAVR(id)
+	return avr, err
+}
+
+// configure handles each configuration action
+// configLock is held while the config is read or changed, but not while talking to the AVRs, so a slow
+// (or offline) AVR doesn't hold up the pollers, events, API or other requests
+func (c *configService) configure(ctx context.Context, request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	// actions send a map of form values (plain string values)
+	var values map[string]string
 	switch request.Action {
-	case "list":
-		return c.list()
-	case "":
-		// present the list or new AVR screen
-		if len(c.driver.config.AVRs) > 0 {
-			return c.list()
+	case "", "list", "new":
+	default:
+		if err := json.Unmarshal(request.Data, &values); err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal %s config request %s: %s", request.Action, request.Data, err))
 		}
-		fallthrough
-	case "new":
-		return c.edit(AVRConfig{})
+	}
 
-	case "edit":
-		var values map[string]string
-		err := json.Unmarshal(request.Data, &values)
+	switch request.Action {
+	case "save":
+		// anything wrong goes back to the edit form with what was typed, so nothing has to be re-entered
+		cfg, problems := validateAVR(values)
+		existing := AVRConfig{}
+		if current, _, err := c.driver.lookupAVR(cfg.ID); err == nil {
+			existing = *current
+		}
+		if len(problems) > 0 {
+			return c.edit(existing, values, problems)
+		}
+
+		err := c.driver.saveAVR(ctx, cfg)
 		if err != nil {
-			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+			return c.edit(existing, values, map[string]string{"": fmt.Sprintf("Could not save AVR: %s", err)})
 		}
 
-		config, ok := c.driver.config.AVRs[values["avr"]]
-		if !ok {
-			return c.error(fmt.Sprintf("Could not find AVR with id: %s", values["avr"]))
+		return c.locked(c.list)
+
+	case "retryPending":
+		if err := c.driver.tryPending(ctx, values["ip"]); err != nil {
+			return c.error(fmt.Sprintf("Still could not connect to AVR at %s: %s", values["ip"], err))
 		}
-		return c.edit(*config)
+		return c.locked(c.list)
 
-	case "delete":
-		var values map[string]string
-		err := json.Unmarshal(request.Data, &values)
-		if err != nil {
-			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	case "refresh":
+		// the only action that asks the AVRs for their status, other screens use what the poller last read
+		if values["ID"] != "" {
+			avr, device, err := c.driver.lookupAVR(values["ID"])
+			if err != nil {
+				return c.error(err.Error())
+			}
+			c.driver.poll(ctx, device, avr)
+			return c.control(avr, device)
 		}
+		c.driver.configLock.Lock()
+		var ids []string
+		for id := range c.driver.config.AVRs {
+			ids = append(ids, id)
+		}
+		c.driver.configLock.Unlock()
+		for _, id := range ids {
+			if avr, device, err := c.driver.lookupAVR(id); err == nil {
+				c.driver.poll(ctx, device, avr)
+			}
+		}
+		return c.locked(c.list)
 
-		err = c.driver.deleteAVR(values["avr"])
-		if err != nil {
-			return c.error(fmt.Sprintf("Failed to delete AVR: %s", err))
+	case "", "list", "new", "edit", "delete", "confirmDelete", "deletePending", "settings", "diagnostics",
+		"saveSettings", "export", "import", "previewImport", "applyImport":
+		c.driver.configLock.Lock()
+		defer c.driver.configLock.Unlock()
+		return c.configureDriver(request.Action, values)
+	}
+
+	// the rest of the actions are all for one AVR, and work on a copy of its config
+	avr, device, err := c.driver.lookupAVR(values["ID"])
+	if err != nil {
+		return c.error(err.Error())
+	}
+
+	switch request.Action {
+	case "toggleOnOff":
+		// turn on/off (which updates state)
+		if err := device.ToggleOnOff(); err != nil {
+			return c.error(fmt.Sprintf("Failed to turn %s on/off: %s", avr.Name, err))
 		}
+		return c.locked(c.list)
 
-		return c.list()
+	case "turnOn", "turnOff":
+		if err := device.SetOnOff(request.Action == "turnOn"); err != nil {
+			return c.error(fmt.Sprintf("Failed to turn %s on/off: %s", avr.Name, err))
+		}
+		return c.control(avr, device)
 
-	case "save":
-		var cfg AVRConfig
-		err := json.Unmarshal(request.Data, &cfg)
-		if err != nil {
-			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	case "control":
+		return c.control(avr, device)
+
+	case "input":
+		if !avr.Capabilities.hasInput(values["input"]) {
+			return c.error(fmt.Sprintf("%s doesn't have input %s", avr.Name, values["input"]))
+		}
+		if err := device.setInput(ctx, values["input"], avr.Zone); err != nil {
+			return c.error(fmt.Sprintf("Failed to select input %s: %s", values["input"], err))
 		}
+		return c.control(avr, device)
 
-		err = c.driver.saveAVR(cfg)
-		if err != nil {
-			return c.error(fmt.Sprintf("Could not save AVR: %s", err))
+	case "soundProgram":
+		program := strings.TrimSpace(values["soundProgram"])
+		if !avr.Capabilities.hasSoundPrograms(avr.Zone) {
+			return c.error(fmt.Sprintf("Zone %d of %s doesn't have DSP programs", avr.Zone, avr.Name))
+		}
+		if program == "" {
+			return c.error("Enter the name of a DSP program")
 		}
+		if err := device.setSoundProgram(ctx, program, avr.Zone); err != nil {
+			return c.error(fmt.Sprintf("Failed to select DSP program %s: %s", program, err))
+		}
+		return c.control(avr, device)
 
-		return c.list()
+	case "tunerBand":
+		if !avr.Capabilities.hasTunerBand(values["band"]) {
+			return c.error(fmt.Sprintf("%s's tuner doesn't have band %s", avr.Name, values["band"]))
+		}
+		if err := device.client.SetTunerBand(ctx, values["band"]); err != nil {
+			return c.error(fmt.Sprintf("Failed to switch tuner to %s: %s", values["band"], err))
+		}
+		return c.control(avr, device)
 
-	case "toggleOnOff":
-		var cfg AVRConfig
-		err := json.Unmarshal(request.Data, &cfg)
+	case "zone":
+		zoneNumber, err := strconv.Atoi(values["zone"])
+		if err != nil || zoneNumber < 1 || zoneNumber > avr.Zones && zoneNumber != 1 {
+			return c.error(fmt.Sprintf("Invalid zone: %s", values["zone"]))
+		}
+		logFor(avr).zone(zoneNumber).op("selectZone").Infof("Zone selected")
+		// send/save config
+		avr, err = c.change(avr.ID, func() error {
+			config, ok := c.driver.config.AVRs[avr.ID]
+			if !ok {
+				return fmt.Errorf("Could not find AVR with id: %s", avr.ID)
+			}
+			c.driver.updateAVR(config, func(config *AVRConfig) { config.Zone = zoneNumber })
+			return c.driver.SendEvent("config", c.driver.config)
+		})
 		if err != nil {
-			return c.error(fmt.Sprintf("Failed to unmarshal turnOn config request %s: %s", request.Data, err))
+			return c.error(fmt.Sprintf("Failed to select zone: %s", err))
 		}
-		// turn on/off (which updates state)
-		c.driver.devices[cfg.ID].ToggleOnOff()
-		return c.list()
+		return c.control(avr, device)
+
+	case "browse":
+		input := values["browseInput"]
+		if !avr.Capabilities.canBrowse(input) {
+			return c.error(fmt.Sprintf("Input %s can't be browsed", input))
+		}
+		// browsing only works on the zone's current input
+		if status, _ := device.status.Zone(avr.Zone); status.Input != input {
+			if err := device.setInput(ctx, input, avr.Zone); err != nil {
+				return c.error(fmt.Sprintf("Failed to select input %s: %s", input, err))
+			}
+		}
+		return c.browse(ctx, avr, device, input)
 
-	case "turnOn":
-		var cfg AVRConfig
-		err := json.Unmarshal(request.Data, &cfg)
+	case "browseSelect":
+		input := values["input"]
+		line, _ := strconv.Atoi(values["line"])
+		info, err := device.client.listInfo(ctx, input)
 		if err != nil {
-			return c.error(fmt.Sprintf("Failed to unmarshal turnOn config request %s: %s", request.Data, err))
+			return c.error(fmt.Sprintf("Failed to read %s menu: %s", input, err))
+		}
+		if line < 1 || line > len(info.List.Lines) {
+			return c.browse(ctx, avr, device, input)
 		}
-		c.driver.devices[cfg.ID].SetOnOff(true)
-		return c.control(c.driver.config.AVRs[cfg.ID])
+		selected := info.List.Lines[line-1]
+		if err := device.client.listSelect(ctx, input, line); err != nil {
+			return c.error(fmt.Sprintf("Failed to select %s: %s", selected.Text, err))
+		}
+		// keep track of where we are so it can be bookmarked
+		switch selected.Attribute {
+		case "Container":
+			device.browsing.enter(input, selected.Text)
+		case "Item":
+			device.browsing.play(input, selected.Text)
+		}
+		return c.browse(ctx, avr, device, input)
 
-	case "turnOff":
-		var cfg AVRConfig
-		err := json.Unmarshal(request.Data, &cfg)
+	case "browseNav":
+		input := values["input"]
+		switch values["nav"] {
+		case "back":
+			err = device.client.listBack(ctx, input)
+			if err == nil {
+				device.browsing.leave(input)
+			}
+		case "home":
+			err = device.client.listHome(ctx, input)
+			if err == nil {
+				device.browsing.home(input)
+			}
+		case "up", "down":
+			err = device.client.listPage(ctx, input, values["nav"] == "up")
+		case "bookmark":
+			if len(device.browsing.playedPath(input)) == 0 {
+				return c.error(fmt.Sprintf("Play something on %s before bookmarking it", input))
+			}
+			return c.bookmark(avr, device, input)
+		}
 		if err != nil {
-			return c.error(fmt.Sprintf("Failed to unmarshal turnOn config request %s: %s", request.Data, err))
+			return c.error(fmt.Sprintf("Failed to navigate %s menu: %s", input, err))
 		}
-		c.driver.devices[cfg.ID].SetOnOff(false)
-		return c.control(c.driver.config.AVRs[cfg.ID])
+		return c.browse(ctx, avr, device, input)
 
-	case "control":
-		var cfg AVRConfig
-		err := json.Unmarshal(request.Data, &cfg)
+	case "saveFavourite":
+		favourite := Favourite{
+			Name:  values["name"],
+			Input: values["input"],
+		}
+		// favourites come either from the new favourite form (with a preset field) or from bookmarking while browsing
+		_, fromForm := values["preset"]
+		if !avr.Capabilities.hasInput(favourite.Input) {
+			return c.error(fmt.Sprintf("%s doesn't have input %s", avr.Name, favourite.Input))
+		}
+		if fromForm {
+			favourite.Preset, _ = strconv.Atoi(values["preset"])
+			if favourite.Preset > 0 && !avr.Capabilities.has("Tuner") {
+				return c.error(fmt.Sprintf("%s doesn't have a tuner", avr.Name))
+			}
+		} else {
+			// only a path played on the favourite's input, so a bookmark can't be for another input's menu
+			favourite.Path = device.browsing.playedPath(favourite.Input)
+			if len(favourite.Path) == 0 {
+				return c.error(fmt.Sprintf("Play something on %s before bookmarking it", favourite.Input))
+			}
+		}
+		avr, err = c.change(avr.ID, func() error { return c.driver.addFavourite(avr.ID, favourite) })
 		if err != nil {
-			return c.error(fmt.Sprintf("Failed to unmarshal control config request %s: %s", request.Data, err))
+			return c.error(fmt.Sprintf("Failed to save favourite: %s", err))
+		}
+		if fromForm {
+			return c.control(avr, device)
 		}
-		return c.control(c.driver.config.AVRs[cfg.ID])
+		return c.browse(ctx, avr, device, values["input"])
 
-	case "input":
-		var values map[string]string
-		err := json.Unmarshal(request.Data, &values)
+	case "newFavourite":
+		return c.newFavourite(avr)
+
+	case "playFavourite", "deleteFavourite":
+		// by name, like the favourites service, so a stale screen can't play or delete the wrong one
+		name := values["favourite"]
+		if request.Action == "playFavourite" {
+			_, err = c.driver.playFavourite(ctx, avr.ID, name, 0)
+		} else {
+			avr, err = c.change(avr.ID, func() error { return c.driver.deleteFavourite(avr.ID, name) })
+		}
 		if err != nil {
-			return c.error(fmt.Sprintf("Failed to unmarshal input config request %s: %s", request.Data, err))
+			return c.error(fmt.Sprintf("Favourite failed: %s", err))
 		}
-		c.driver.config.AVRs[values["ID"]].SetInput(values["input"], c.driver.config.AVRs[values["ID"]].Zone)
-		// send/save config
-		//		c.driver.config.AVRs[values["ID"]].Input =
-		//		c.driver.SendEvent("config", c.driver.config)
-		return c.control(c.driver.config.AVRs[values["ID"]])
+		// the browse screen sends the input being browsed, the control screen doesn't
+		if values["input"] != "" {
+			return c.browse(ctx, avr, device, values["input"])
+		}
+		return c.control(avr, device)
 
-	case "zone":
-		var values map[string]string
-		err := json.Unmarshal(request.Data, &values)
+	default:
+		return c.error(fmt.Sprintf("Unknown action: %s", request.Action))
+	}
+}
+
+// configureDriver handles the actions that only use the config (not the AVRs)
+// the caller holds configLock
+func (c *configService) configureDriver(action string, values map[string]string) (*suit.ConfigurationScreen, error) {
+	switch action {
+	case "list":
+		return c.list()
+	case "":
+		// present the list or new AVR screen
+		if len(c.driver.config.AVRs) > 0 || len(c.driver.config.Pending) > 0 {
+			return c.list()
+		}
+		fallthrough
+	case "new":
+		return c.edit(AVRConfig{}, nil, nil)
+
+	case "edit":
+		config, ok := c.driver.config.AVRs[values["avr"]]
+		if !ok {
+			return c.error(fmt.Sprintf("Could not find AVR with id: %s", values["avr"]))
+		}
+		return c.edit(*config, nil, nil)
+
+	case "delete":
+		if _, ok := c.driver.config.AVRs[values["avr"]]; !ok {
+			return c.error(fmt.Sprintf("Could not find AVR with id: %s", values["avr"]))
+		}
+		err := c.driver.deleteAVR(values["avr"])
 		if err != nil {
-			return c.error(fmt.Sprintf("Failed to unmarshal input config request %s: %s", request.Data, err))
+			return c.error(fmt.Sprintf("Failed to delete AVR: %s", err))
 		}
-		zoneNumber, _ := strconv.Atoi(values["zone"])
-		log.Infof("\nzone - %v\n", zoneNumber)
-		// send/save config
-		c.driver.config.AVRs[values["ID"]].Zone = zoneNumber
-		c.driver.SendEvent("config", c.driver.config)
-		return c.control(c.driver.config.AVRs[values["ID"]])
+
+		return c.list()
 
 	case "confirmDelete":
-		var values map[string]string
-		err := json.Unmarshal(request.Data, &values)
-		if err != nil {
-			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		if _, ok := c.driver.config.AVRs[values["avr"]]; !ok {
+			return c.error(fmt.Sprintf("Could not find AVR with id: %s", values["avr"]))
 		}
 		return c.confirmDelete(values["avr"])
-	default:
-		return c.error(fmt.Sprintf("Unknown action: %s", request.Action))
+
+	case "deletePending":
+		if err := c.driver.deletePending(values["ip"]); err != nil {
+			return c.error(fmt.Sprintf("Failed to delete AVR: %s", err))
+		}
+		return c.list()
+
+	case "settings":
+		return c.settings(nil, nil)
+
+	case "diagnostics":
+		return c.diagnostics()
+
+	case "saveSettings":
+		settings, problems := validateSettings(values)
+		if len(problems) > 0 {
+			return c.settings(values, problems)
+		}
+		if err := c.driver.saveSettings(settings); err != nil {
+			return c.settings(values, map[string]string{"": fmt.Sprintf("Could not save settings: %s", err)})
+		}
+		return c.list()
+
+	case "export":
+		return c.export()
+
+	case "import":
+		return c.importForm(values["config"], values["mode"], nil)
+
+	case "previewImport", "applyImport":
+		// the config is checked again before it's applied, as it comes back from the preview screen
+		config, problems := parseImport(values["config"])
+		replace := values["mode"] == "replace"
+		if len(problems) > 0 {
+			return c.importForm(values["config"], values["mode"], problems)
+		}
+		if action == "previewImport" {
+			return c.importPreview(values["config"], values["mode"], c.driver.importChanges(config, replace))
+		}
+		if err := c.driver.importConfig(config, replace); err != nil {
+			return c.error(fmt.Sprintf("Import failed part way through: %s", err))
+		}
+		return c.list()
 	}
+	return c.error(fmt.Sprintf("Unknown action: %s", action))
+}
+
+// updatedAgo describes how old the cached status shown on a screen is
+func updatedAgo(updated time.Time) string {
+	if updated.IsZero() {
+		return "Status not read yet - refresh to check"
+	}
+	return fmt.Sprintf("Last updated %d s ago", int(time.Since(updated).Seconds()))
+}
+
+// queueSummary describes how busy an AVR's command queue is
+func queueSummary(stats ync.QueueStats) string {
+	return fmt.Sprintf("%d commands queued (at most %d), %d sent, %d merged", stats.Depth, stats.MaxDepth, stats.Processed, stats.Coalesced)
 }
 
 // error is a generic config screen for displaying error messages
@@ -184,38 +455,46 @@ func (c *configService) error(message string) (*suit.ConfigurationScreen, error)
 }
 
 // control is a config screen for controlling an AVR
-func (c *configService) control(avr *AVRConfig) (*suit.ConfigurationScreen, error) {
+func (c *configService) control(avr *AVRConfig, device *Device) (*suit.ConfigurationScreen, error) {
 	var inputActions []suit.ActionListOption
 	mainTitle := "Main"
-	// if zone has not been set, make it the default (main zone)
-	if avr.Zone == 0 {
-		avr.Zone = 1
+	// if zone has not been set, use the default (main zone)
+	zone := avr.Zone
+	if zone == 0 {
+		zone = 1
 	}
-	if avr.Zone == 1 {
+	if zone == 1 {
 		mainTitle += " *"
 	}
 	zoneActions := []suit.ActionListOption{suit.ActionListOption{
 		Title: mainTitle,
 		Value: "1",
 	}}
-	// TODO: (one day if needed), show inputs relevant to current zone (e.g. Zone 2 has no HDMI)
+	// TODO: (one day if needed), show inputs relevant to current zone (e.g. Zone 2 has no HDMI),
+	// only the main zone's inputs are detected
 	// create input actions - only if power is on
-	var inputSection suit.Section
-	if powerOn, _ := avr.GetPower(avr.Zone); powerOn {
-
-		currentInput, _ := avr.GetInput(avr.Zone)
-		for _, input := range inputs {
+	var inputSection, browseSection, soundSection, tunerSection suit.Section
+	var browseActions []suit.ActionListOption
+	// power and input come from the poller's cache rather than asking the AVR every time
+	if status, _ := device.status.Zone(zone); status.Power {
+		for _, input := range avr.Capabilities.inputs() {
 			selected := ""
-			if input == currentInput {
+			if input == status.Input {
 				selected = " *"
 			}
 			inputActions = append(inputActions, suit.ActionListOption{
 				Title: input + selected,
 				Value: input,
 			})
+			if avr.Capabilities.canBrowse(input) {
+				browseActions = append(browseActions, suit.ActionListOption{
+					Title: input,
+					Value: input,
+				})
+			}
 		}
 		inputSection = suit.Section{
-			Title: "Select Input - Zone " + fmt.Sprintf("%v", avr.Zone),
+			Title: "Select Input - Zone " + fmt.Sprintf("%v", zone),
 			Contents: []suit.Typed{
 				suit.InputHidden{
 					Name:  "ID",
@@ -231,6 +510,71 @@ func (c *configService) control(avr *AVRConfig) (*suit.ConfigurationScreen, erro
 				},
 			},
 		}
+		// only inputs the AVR has that can be browsed
+		if len(browseActions) > 0 {
+			browseSection = suit.Section{
+				Title: "Browse - Zone " + fmt.Sprintf("%v", zone),
+				Contents: []suit.Typed{
+					suit.InputHidden{
+						Name:  "ID",
+						Value: avr.ID,
+					},
+					suit.ActionList{
+						Name:    "browseInput",
+						Options: browseActions,
+						PrimaryAction: &suit.ReplyAction{
+							Name:        "browse",
+							DisplayIcon: "list",
+						},
+					},
+				},
+			}
+		}
+		// the status only has a program if the zone has them, which also covers AVRs that weren't detected
+		if avr.Capabilities.hasSoundPrograms(zone) && status.SoundProgram != "" {
+			soundSection = suit.Section{
+				Title: "Sound Program - Zone " + fmt.Sprintf("%v", zone),
+				Contents: []suit.Typed{
+					suit.InputHidden{
+						Name:  "ID",
+						Value: avr.ID,
+					},
+					suit.InputText{
+						Name:        "soundProgram",
+						Before:      "DSP",
+						Value:       status.SoundProgram,
+						Placeholder: "e.g. Standard, 7ch Stereo",
+					},
+				},
+			}
+		}
+		// switching band only makes sense while listening to the tuner, and with more than one band
+		if bands := avr.Capabilities.tunerBands(); status.Input == "TUNER" && len(bands) > 1 {
+			var bandActions []suit.ActionListOption
+			for _, band := range bands {
+				bandActions = append(bandActions, suit.ActionListOption{
+					Title: band,
+					Value: band,
+				})
+			}
+			tunerSection = suit.Section{
+				Title: "Tuner Band - Zone " + fmt.Sprintf("%v", zone),
+				Contents: []suit.Typed{
+					suit.InputHidden{
+						Name:  "ID",
+						Value: avr.ID,
+					},
+					suit.ActionList{
+						Name:    "band",
+						Options: bandActions,
+						PrimaryAction: &suit.ReplyAction{
+							Name:        "tunerBand",
+							DisplayIcon: "signal",
+						},
+					},
+				},
+			}
+		}
 	} else {
 		inputSection = suit.Section{
 			Title: "Zone selection not available when power is off",
@@ -239,7 +583,7 @@ func (c *configService) control(avr *AVRConfig) (*suit.ConfigurationScreen, erro
 	// create zone actions (main zone is already defined)
 	for i := 2; i < avr.Zones+1; i++ {
 		selected := ""
-		if i == avr.Zone {
+		if i == zone {
 			selected = " *"
 		}
 		zoneActions = append(zoneActions, suit.ActionListOption{
@@ -248,8 +592,42 @@ func (c *configService) control(avr *AVRConfig) (*suit.ConfigurationScreen, erro
 		})
 	}
 
+	// favourites can be played whether or not the zone is on (playing turns it on)
+	favouriteActions := []suit.ActionListOption{}
+	for _, favourite := range avr.Favourites {
+		favouriteActions = append(favouriteActions, suit.ActionListOption{
+			Title:    favourite.Name,
+			Subtitle: favourite.Description(),
+			Value:    favourite.Name,
+		})
+	}
+	favouriteSection := suit.Section{
+		Title: "Favourites - Zone " + fmt.Sprintf("%v", zone),
+		Contents: []suit.Typed{
+			suit.InputHidden{
+				Name:  "ID",
+				Value: avr.ID,
+			},
+			suit.ActionList{
+				Name:    "favourite",
+				Options: favouriteActions,
+				PrimaryAction: &suit.ReplyAction{
+					Name:        "playFavourite",
+					DisplayIcon: "star",
+				},
+				SecondaryAction: &suit.ReplyAction{
+					Name:         "deleteFavourite",
+					Label:        "Delete",
+					DisplayIcon:  "trash",
+					DisplayClass: "danger",
+				},
+			},
+		},
+	}
+
 	screen := suit.ConfigurationScreen{
-		Title: "Control " + avr.Name + " (" + avr.Model + ")",
+		Title:    "Control " + avr.Name + " (" + avr.Model + ")",
+		Subtitle: updatedAgo(device.status.Updated()) + " - " + queueSummary(device.client.QueueStats()),
 		Sections: []suit.Section{
 			suit.Section{
 				Title: "Select Zone",
@@ -268,9 +646,13 @@ func (c *configService) control(avr *AVRConfig) (*suit.ConfigurationScreen, erro
 					},
 				},
 			},
-			inputSection, // this is the input selection (only useful when AVR is on)
+			inputSection,  // this is the input selection (only useful when AVR is on)
+			browseSection, // browsing NET RADIO etc. (also only when on)
+			soundSection,  // DSP program, if the zone has them (also only when on)
+			tunerSection,  // tuner band, when the input is TUNER
+			favouriteSection,
 			suit.Section{
-				Title: "Power - Zone " + fmt.Sprintf("%v", avr.Zone),
+				Title: "Power - Zone " + fmt.Sprintf("%v", zone),
 				Contents: []suit.Typed{
 					suit.ActionList{
 						Name:    "ID",
@@ -295,11 +677,250 @@ func (c *configService) control(avr *AVRConfig) (*suit.ConfigurationScreen, erro
 				Label: "Back",
 				Name:  "list",
 			},
+			suit.ReplyAction{
+				Label:       "Refresh",
+				Name:        "refresh",
+				DisplayIcon: "refresh",
+			},
+			suit.ReplyAction{
+				Label:        "New Favourite",
+				Name:         "newFavourite",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+	// the sound program is a text field, so it's sent by a screen action rather than a list
+	if len(soundSection.Contents) > 0 {
+		screen.Actions = append(screen.Actions, suit.ReplyAction{
+			Label:       "Set Sound Program",
+			Name:        "soundProgram",
+			DisplayIcon: "music",
+		})
+	}
+	return &screen, nil
+}
+
+// browse is a config screen for walking the menus of a browsable input (NET RADIO, SERVER, USB)
+// and playing or bookmarking items
+func (c *configService) browse(ctx context.Context, avr *AVRConfig, device *Device, input string) (*suit.ConfigurationScreen, error) {
+	info, err := device.client.waitListReady(ctx, input)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to read %s menu: %s", input, err))
+	}
+	// the AVR can be browsed with the remote too, so don't trust a path deeper than the current menu
+	device.browsing.trim(input, info.Layer)
+
+	var lineActions []suit.ActionListOption
+	for i, line := range info.List.Lines {
+		title := line.Text
+		if line.Attribute == "Container" {
+			title += " >"
+		}
+		lineActions = append(lineActions, suit.ActionListOption{
+			Title: title,
+			Value: strconv.Itoa(i + 1),
+		})
+	}
+	start := info.PageStart()
+	navActions := []suit.ActionListOption{
+		suit.ActionListOption{Title: "Back", Value: "back"},
+		suit.ActionListOption{Title: "Home", Value: "home"},
+	}
+	if start > 1 {
+		navActions = append(navActions, suit.ActionListOption{Title: "Previous Page", Value: "up"})
+	}
+	if start+linesPerPage <= info.Cursor.MaxLine {
+		navActions = append(navActions, suit.ActionListOption{Title: "Next Page", Value: "down"})
+	}
+	if played := device.browsing.playedPath(input); len(played) > 0 {
+		navActions = append(navActions, suit.ActionListOption{
+			Title: "Bookmark " + played[len(played)-1],
+			Value: "bookmark",
+		})
+	}
+
+	var favouriteActions []suit.ActionListOption
+	for _, favourite := range avr.Favourites {
+		if favourite.Input == input {
+			favouriteActions = append(favouriteActions, suit.ActionListOption{
+				Title: favourite.Name,
+				Value: favourite.Name,
+			})
+		}
+	}
+
+	hidden := []suit.Typed{
+		suit.InputHidden{
+			Name:  "ID",
+			Value: avr.ID,
+		},
+		suit.InputHidden{
+			Name:  "input",
+			Value: input,
+		},
+	}
+	sections := []suit.Section{
+		suit.Section{
+			Title: fmt.Sprintf("%s (%d-%d of %d)", info.MenuName, start, start+len(info.List.Lines)-1, info.Cursor.MaxLine),
+			Contents: append(hidden, suit.ActionList{
+				Name:    "line",
+				Options: lineActions,
+				PrimaryAction: &suit.ReplyAction{
+					Name:        "browseSelect",
+					DisplayIcon: "play",
+				},
+			}),
+		},
+		suit.Section{
+			Title: "Navigate",
+			Contents: append(hidden, suit.ActionList{
+				Name:    "nav",
+				Options: navActions,
+				PrimaryAction: &suit.ReplyAction{
+					Name:        "browseNav",
+					DisplayIcon: "arrow-circle-right",
+				},
+			}),
+		},
+	}
+	if len(favouriteActions) > 0 {
+		sections = append(sections, suit.Section{
+			Title: "Favourites",
+			Contents: append(hidden, suit.ActionList{
+				Name:    "favourite",
+				Options: favouriteActions,
+				PrimaryAction: &suit.ReplyAction{
+					Name:        "playFavourite",
+					DisplayIcon: "star",
+				},
+				SecondaryAction: &suit.ReplyAction{
+					Name:         "deleteFavourite",
+					Label:        "Delete",
+					DisplayIcon:  "trash",
+					DisplayClass: "danger",
+				},
+			}),
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title:    "Browse " + input + " - " + avr.Name,
+		Sections: sections,
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Back",
+				Name:  "control",
+			},
 		},
 	}
 	return &screen, nil
 }
 
+// bookmark is a config screen for naming the last played item before saving it as a favourite
+func (c *configService) bookmark(avr *AVRConfig, device *Device, input string) (*suit.ConfigurationScreen, error) {
+	path := device.browsing.playedPath(input)
+	return &suit.ConfigurationScreen{
+		Title:    "New Favourite",
+		Subtitle: strings.Join(path, " > "),
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.InputHidden{
+						Name:  "ID",
+						Value: avr.ID,
+					},
+					suit.InputHidden{
+						Name:  "input",
+						Value: input,
+					},
+					suit.InputText{
+						Name:        "name",
+						Before:      "Name",
+						Placeholder: "Favourite name",
+						Value:       path[len(path)-1],
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "list",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveFavourite",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}, nil
+}
+
+// newFavourite is a config screen for adding a favourite input, with an optional tuner preset
+// (NET RADIO etc. favourites are bookmarked from the browse screen)
+func (c *configService) newFavourite(avr *AVRConfig) (*suit.ConfigurationScreen, error) {
+	var inputOptions []suit.RadioGroupOption
+	for _, input := range avr.Capabilities.inputs() {
+		inputOptions = append(inputOptions, suit.RadioGroupOption{
+			Title: input,
+			Value: input,
+		})
+	}
+	fields := []suit.Typed{
+		suit.InputHidden{
+			Name:  "ID",
+			Value: avr.ID,
+		},
+		suit.InputText{
+			Name:        "name",
+			Before:      "Name",
+			Placeholder: "e.g. ABC Classic",
+		},
+		suit.RadioGroup{
+			Name:    "input",
+			Title:   "Input",
+			Value:   avr.Capabilities.inputs()[0],
+			Options: inputOptions,
+		},
+	}
+	// the preset field is always sent (even blank) so saveFavourite knows the favourite came from this form
+	if avr.Capabilities.has("Tuner") {
+		fields = append(fields, suit.InputText{
+			Name:        "preset",
+			Before:      "Tuner Preset",
+			Placeholder: "TUNER only, leave blank for other inputs",
+		})
+	} else {
+		fields = append(fields, suit.InputHidden{
+			Name:  "preset",
+			Value: "",
+		})
+	}
+	return &suit.ConfigurationScreen{
+		Title:    "New Favourite - " + avr.Name,
+		Subtitle: "To save a NET RADIO, SERVER or USB item, browse to it and bookmark it.",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: fields,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "control",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveFavourite",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}, nil
+}
+
 // list is a config screen for displaying each of the AVRs with options for editing, deleting and controlling
 func (c *configService) list() (*suit.ConfigurationScreen, error) {
 
@@ -307,14 +928,35 @@ func (c *configService) list() (*suit.ConfigurationScreen, error) {
 	var avrActions []suit.ActionListOption
 
 	for _, avr := range c.driver.config.AVRs {
+		device, ok := c.driver.devices[avr.ID]
+		if !ok {
+			// the device couldn't be created, so it can only be edited or deleted
+			avrs = append(avrs, suit.ActionListOption{
+				Title:    avr.Name + " (" + avr.Model + ")",
+				Subtitle: "Not running - restart the driver",
+				Value:    avr.ID,
+			})
+			continue
+		}
+		offline, since := device.health.Offline()
+		status := updatedAgo(device.status.Updated())
+		if offline {
+			status = "Unreachable since " + since.Format("Mon 15:04")
+		}
 		// create edit actions
 		avrs = append(avrs, suit.ActionListOption{
-			Title: avr.Name + " (" + avr.Model + ")",
-			Value: avr.ID,
+			Title:    avr.Name + " (" + avr.Model + ")",
+			Subtitle: status,
+			Value:    avr.ID,
 		})
-		// create power actions
+		// create power actions (don't wait on an AVR we know is unreachable)
+		if offline {
+			continue
+		}
 		title := avr.Name
-		if isOn, _ := c.driver.devices[avr.ID].IsOn(); isOn {
+		if zoneStatus, ok := device.status.Zone(avr.Zone); !ok {
+			title += " - Turn On/Off"
+		} else if zoneStatus.Power {
 			title += " (On) - Turn Off"
 		} else {
 			title += " (Off) - Turn On"
@@ -325,6 +967,16 @@ func (c *configService) list() (*suit.ConfigurationScreen, error) {
 		})
 	}
 
+	// AVRs that were offline when they were saved, they're added when they can be reached
+	var pending []suit.ActionListOption
+	for ip, avr := range c.driver.config.Pending {
+		pending = append(pending, suit.ActionListOption{
+			Title:    avr.Name + " (" + ip + ")",
+			Subtitle: "Waiting to connect",
+			Value:    ip,
+		})
+	}
+
 	screen := suit.ConfigurationScreen{
 		Title: "Yamaha AV Receivers",
 		Sections: []suit.Section{
@@ -371,6 +1023,31 @@ func (c *configService) list() (*suit.ConfigurationScreen, error) {
 			suit.CloseAction{
 				Label: "Close",
 			},
+			suit.ReplyAction{
+				Label:       "Refresh",
+				Name:        "refresh",
+				DisplayIcon: "refresh",
+			},
+			suit.ReplyAction{
+				Label:       "Settings",
+				Name:        "settings",
+				DisplayIcon: "cog",
+			},
+			suit.ReplyAction{
+				Label:       "Diagnostics",
+				Name:        "diagnostics",
+				DisplayIcon: "heartbeat",
+			},
+			suit.ReplyAction{
+				Label:       "Export",
+				Name:        "export",
+				DisplayIcon: "upload",
+			},
+			suit.ReplyAction{
+				Label:       "Import",
+				Name:        "import",
+				DisplayIcon: "download",
+			},
 			suit.ReplyAction{
 				Label:        "New AVR",
 				Name:         "new",
@@ -380,90 +1057,128 @@ func (c *configService) list() (*suit.ConfigurationScreen, error) {
 		},
 	}
 
+	if len(pending) > 0 {
+		screen.Sections = append(screen.Sections, suit.Section{
+			Title: "Waiting to Connect",
+			Contents: []suit.Typed{
+				suit.ActionList{
+					Name:    "ip",
+					Options: pending,
+					PrimaryAction: &suit.ReplyAction{
+						Name:        "retryPending",
+						Label:       "Try Now",
+						DisplayIcon: "refresh",
+					},
+					SecondaryAction: &suit.ReplyAction{
+						Name:         "deletePending",
+						Label:        "Delete",
+						DisplayIcon:  "trash",
+						DisplayClass: "danger",
+					},
+				},
+			},
+		})
+	}
+
 	return &screen, nil
 }
 
 // edit is a config screen for editing the config of an AVR
-func (c *configService) edit(config AVRConfig) (*suit.ConfigurationScreen, error) {
+// values are what's shown in the form (nil to use the config's values) and problems are
+// messages for fields that didn't validate, shown under each field
+func (c *configService) edit(config AVRConfig, values map[string]string, problems map[string]string) (*suit.ConfigurationScreen, error) {
 
 	var title string
 	if config.ID != "" {
 		title = "Editing Yamaha AVR (" + config.Model + ")"
 	} else {
 		title = "New Yamaha AVR"
-		config.MaxVolume = avryamaha.MaxVolume
-		config.UpdateInterval = 5
-		config.Zones = 2
+		if values == nil {
+			config.MaxVolume = avryamaha.MaxVolume
+			config.UpdateInterval = 5
+			config.Timeout = ync.DefaultTimeout.Seconds()
+		}
+	}
+	if values == nil {
+		values = avrFormValues(config)
 	}
 
+	subtitle := "Please complete all fields."
+	if len(problems) > 0 {
+		subtitle = "Please fix the problems below."
+	}
+
+	fields := formProblem(nil, problems)
+	field := func(name, before, placeholder string) {
+		fields = formField(fields, values, problems, name, before, placeholder)
+	}
+	fields = append(fields, suit.InputHidden{
+		Name:  "id",
+		Value: values["id"],
+	})
+	field("name", "Name", "Preferred name")
+	field("ip", "IP", "IP address")
+	zonesPlaceholder := "Blank to detect them"
+	if config.Zones > 0 {
+		zonesPlaceholder = fmt.Sprintf("Blank to detect them (found %d)", config.Zones)
+	}
+	field("zones", "Zones", zonesPlaceholder)
+	field("maxVolume", "Max Volume", "Use multiples of 0.5")
+	field("updateInterval", "Update Interval", "in seconds")
+	field("timeout", "Timeout", "seconds to wait for the AVR to respond")
+	var levelOptions []suit.RadioGroupOption
+	for _, level := range logLevels {
+		levelOptions = append(levelOptions, suit.RadioGroupOption{
+			Title: strings.Title(level),
+			Value: level,
+		})
+	}
+	fields = append(fields, suit.RadioGroup{
+		Name:     "logLevel",
+		Title:    "Log Level",
+		Subtitle: "Debug logs every command and poll for this AVR",
+		Value:    values["logLevel"],
+		Options:  levelOptions,
+	})
+	if problem, ok := problems["logLevel"]; ok {
+		fields = append(fields, suit.Alert{
+			Title:        problem,
+			DisplayClass: "danger",
+		})
+	}
+	// volume increment is only relevant/used if ApplyVolume is not defined
+	// leave this code in, in case it's ever needed
+	//					suit.RadioGroup{
+	//						Name:     "volumeIncrement",
+	//						Title:    "Volume Increment",
+	//						Subtitle: "This has no effect unless you change the driver to not implement ApplyVolume",
+	//						Value:    fmt.Sprintf("%0.1f", config.VolumeIncrement), // set selected radio to value in config
+	//						Options: []suit.RadioGroupOption{
+	//							suit.RadioGroupOption{
+	//								Title: "0.5",
+	//								Value: "0.5",
+	//							},
+	//							suit.RadioGroupOption{
+	//								Title: "1",
+	//								Value: "1.0",
+	//							},
+	//							suit.RadioGroupOption{
+	//								Title: "2",
+	//								Value: "2.0",
+	//							},
+	//							suit.RadioGroupOption{
+	//								Title: "5",
+	//								Value: "5.0",
+	//							},
+	//						},
+	//					},
+
 	screen := suit.ConfigurationScreen{
 		Title:    title,
-		Subtitle: "Please complete all fields.",
+		Subtitle: subtitle,
 		Sections: []suit.Section{
 			suit.Section{
-				Contents: []suit.Typed{
-					suit.InputHidden{
-						Name:  "id",
-						Value: config.ID,
-					},
-					suit.InputText{
-						Name:        "name",
-						Before:      "Name",
-						Placeholder: "Preferred name",
-						Value:       config.Name,
-					},
-					suit.InputText{
-						Name:        "ip",
-						Before:      "IP",
-						Placeholder: "IP address",
-						Value:       config.IP,
-					},
-					// NOTE: doesn't seem you can query amp to get # zones
-					suit.InputText{
-						Name:        "zones",
-						Before:      "Zones",
-						Placeholder: "Number of zones (1, 2, ...)",
-						Value:       config.Zones,
-					},
-					suit.InputText{
-						Name:        "maxVolume",
-						Before:      "Max Volume",
-						Placeholder: "Use multiples of 0.5",
-						Value:       config.MaxVolume,
-					},
-					suit.InputText{
-						Name:        "updateInterval",
-						Before:      "Update Interval",
-						Placeholder: "in seconds",
-						Value:       config.UpdateInterval,
-					},
-					// volume increment is only relevant/used if ApplyVolume is not defined
-					// leave this code in, in case it's ever needed
-					//					suit.RadioGroup{
-					//						Name:     "volumeIncrement",
-					//						Title:    "Volume Increment",
-					//						Subtitle: "This has no effect unless you change the driver to not implement ApplyVolume",
-					//						Value:    fmt.Sprintf("%0.1f", config.VolumeIncrement), // set selected radio to value in config
-					//						Options: []suit.RadioGroupOption{
-					//							suit.RadioGroupOption{
-					//								Title: "0.5",
-					//								Value: "0.5",
-					//							},
-					//							suit.RadioGroupOption{
-					//								Title: "1",
-					//								Value: "1.0",
-					//							},
-					//							suit.RadioGroupOption{
-					//								Title: "2",
-					//								Value: "2.0",
-					//							},
-					//							suit.RadioGroupOption{
-					//								Title: "5",
-					//								Value: "5.0",
-					//							},
-					//						},
-					//					},
-				},
+				Contents: fields,
 			},
 		},
 		Actions: []suit.Typed{
@@ -483,6 +1198,193 @@ func (c *configService) edit(config AVRConfig) (*suit.ConfigurationScreen, error
 	return &screen, nil
 }
 
+// formField adds a text input for one of a form's values to fields, followed by its problem if it has one
+func formField(fields []suit.Typed, values, problems map[string]string, name, before, placeholder string) []suit.Typed {
+	fields = append(fields, suit.InputText{
+		Name:        name,
+		Before:      before,
+		Placeholder: placeholder,
+		Value:       values[name],
+	})
+	if problem, ok := problems[name]; ok {
+		fields = append(fields, suit.Alert{
+			Title:        problem,
+			DisplayClass: "danger",
+		})
+	}
+	return fields
+}
+
+// formProblem adds a form's problem that isn't about one field (e.g. couldn't connect), for the top of the form
+func formProblem(fields []suit.Typed, problems map[string]string) []suit.Typed {
+	if problem, ok := problems[""]; ok {
+		fields = append(fields, suit.Alert{
+			Title:        problem,
+			DisplayClass: "danger",
+			DisplayIcon:  "warning",
+		})
+	}
+	return fields
+}
+
+// settings is a config screen for the options that apply to the whole driver rather than one AVR
+func (c *configService) settings(values map[string]string, problems map[string]string) (*suit.ConfigurationScreen, error) {
+	if values == nil {
+		values = settingsFormValues(c.driver.config)
+	}
+	subtitle := "Options for the whole driver. Leave a port or broker blank to turn that feature off."
+	if len(problems) > 0 {
+		subtitle = "Please fix the problems below."
+	}
+
+	api := formProblem(nil, problems)
+	api = formField(api, values, problems, "apiPort", "Port", "e.g. 8090, blank to turn the API off")
+	api = formField(api, values, problems, "apiToken", "Token", "blank to allow anyone on your network")
+
+	metrics := formField(nil, values, problems, "metricsPort", "Port", "e.g. 9100, blank to turn metrics off")
+
+	mqtt := formField(nil, values, problems, "mqttBroker", "Broker", "e.g. tcp://192.168.1.10:1883, blank to turn MQTT off")
+	mqtt = formField(mqtt, values, problems, "mqttUsername", "Username", "blank if the broker doesn't need one")
+	mqtt = formField(mqtt, values, problems, "mqttPassword", "Password", "")
+	mqtt = formField(mqtt, values, problems, "mqttPrefix", "Topic prefix", "blank for "+defaultMQTTPrefix)
+	mqtt = formField(mqtt, values, problems, "mqttDiscoveryPrefix", "Discovery prefix", "blank for Home Assistant's ("+defaultMQTTDiscoveryPrefix+")")
+
+	return &suit.ConfigurationScreen{
+		Title:    "Settings",
+		Subtitle: subtitle,
+		Sections: []suit.Section{
+			suit.Section{
+				Title:    "HTTP API (GET/PUT /avrs/{id}/zones/{n})",
+				Contents: api,
+			},
+			suit.Section{
+				Title:    "Prometheus metrics (GET /metrics)",
+				Contents: metrics,
+			},
+			suit.Section{
+				Title:    "MQTT (each zone is a Home Assistant device)",
+				Contents: mqtt,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "list",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveSettings",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}, nil
+}
+
+// diagnostics is a config screen showing whether the driver and each AVR are working,
+// the same as the health service returns
+func (c *configService) diagnostics() (*suit.ConfigurationScreen, error) {
+	health, err := c.driver.health("")
+	if err != nil {
+		return c.error(err.Error())
+	}
+	when := func(t time.Time) string {
+		if t.IsZero() {
+			return "Never"
+		}
+		return fmt.Sprintf("%s (%d s ago)", t.Format("Mon 15:04:05"), int(time.Since(t).Seconds()))
+	}
+	row := func(title, value string) suit.Typed {
+		return suit.StaticText{Title: title, Value: value}
+	}
+
+	events := "Listening for AVR events"
+	if !health.Events {
+		events = "Not listening for AVR events, polling only"
+	}
+	sections := []suit.Section{
+		suit.Section{
+			Title: "Driver",
+			Contents: []suit.Typed{
+				row("Started", when(health.Started)),
+				row("Uptime", (time.Duration(health.Uptime) * time.Second).String()),
+				row("Events", events),
+			},
+		},
+	}
+
+	for _, avr := range health.AVRs {
+		reachable := "Yes"
+		switch {
+		case !avr.Running:
+			reachable = "Not running - restart the driver"
+		case !avr.Reachable:
+			reachable = "No, since " + when(avr.OfflineSince)
+		}
+		firmware := avr.Firmware
+		if firmware == "" {
+			firmware = "Unknown"
+		}
+		lastError := "None"
+		if avr.LastError != "" {
+			lastError = avr.LastError + " at " + when(avr.LastErrorAt)
+		}
+		contents := []suit.Typed{
+			row("Reachable", reachable),
+			row("Last successful poll", when(avr.LastPoll)),
+			row("Last error", lastError),
+			row("Polls", fmt.Sprintf("%d (%d failed)", avr.Polls, avr.PollFailures)),
+		}
+		for zone := 1; zone <= ync.MaxZones; zone++ {
+			if err, ok := avr.ZoneErrors[strconv.Itoa(zone)]; ok {
+				contents = append(contents, row(fmt.Sprintf("Zone %d error", zone), err))
+			}
+		}
+		contents = append(contents,
+			row("Model", avr.Model),
+			row("Firmware", firmware),
+		)
+		if device, ok := c.driver.devices[avr.ID]; ok {
+			contents = append(contents, row("Queue", queueSummary(device.client.QueueStats())))
+		}
+		sections = append(sections, suit.Section{
+			Title:    avr.Name + " (" + avr.IP + ")",
+			Contents: contents,
+		})
+	}
+	if len(health.Pending) > 0 {
+		var pending []suit.Typed
+		for _, avr := range health.Pending {
+			pending = append(pending, row(avr.Name, avr.IP))
+		}
+		sections = append(sections, suit.Section{
+			Title:    "Waiting to Connect",
+			Contents: pending,
+		})
+	}
+
+	subtitle := "Everything is working"
+	if !health.Healthy {
+		subtitle = "Some AVRs aren't working"
+	}
+	return &suit.ConfigurationScreen{
+		Title:    "Diagnostics",
+		Subtitle: subtitle,
+		Sections: sections,
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Back",
+				Name:  "list",
+			},
+			suit.ReplyAction{
+				Label:       "Refresh",
+				Name:        "diagnostics",
+				DisplayIcon: "refresh",
+			},
+		},
+	}, nil
+}
+
 // confirmDelete is a config screen for confirming/cancelling deleting of AVR
 func (c *configService) confirmDelete(id string) (*suit.ConfigurationScreen, error) {
 	return &suit.ConfigurationScreen{
@@ -517,3 +1419,134 @@ func (c *configService) confirmDelete(id string) (*suit.ConfigurationScreen, err
 		},
 	}, nil
 }
+
+// export is a config screen showing the whole config as JSON, to copy and keep or import somewhere else
+func (c *configService) export() (*suit.ConfigurationScreen, error) {
+	data, err := c.driver.exportConfig()
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to export config: %s", err))
+	}
+	return &suit.ConfigurationScreen{
+		Title:    "Export Config",
+		Subtitle: "Copy this and keep it somewhere safe, then paste it into Import (here or on another Sphere) to restore your AVRs and favourites (settings aren't included).",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.InputText{
+						Name:  "config",
+						Value: string(data),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Back",
+				Name:  "list",
+			},
+		},
+	}, nil
+}
+
+// importForm is a config screen for pasting exported config, with problems from checking it if it was wrong
+// mode is "merge" (keep AVRs that aren't in the config) or "replace"
+func (c *configService) importForm(config, mode string, problems []string) (*suit.ConfigurationScreen, error) {
+	if mode != "replace" {
+		mode = "merge"
+	}
+	var contents []suit.Typed
+	for _, problem := range problems {
+		contents = append(contents, suit.Alert{
+			Title:        problem,
+			DisplayClass: "danger",
+		})
+	}
+	contents = append(contents,
+		suit.InputText{
+			Name:        "config",
+			Before:      "Config",
+			Placeholder: "Paste exported config here",
+			Value:       config,
+		},
+		suit.RadioGroup{
+			Name:  "mode",
+			Title: "AVRs that aren't in the imported config",
+			Value: mode,
+			Options: []suit.RadioGroupOption{
+				suit.RadioGroupOption{
+					Title: "Keep them (merge)",
+					Value: "merge",
+				},
+				suit.RadioGroupOption{
+					Title: "Delete them (replace)",
+					Value: "replace",
+				},
+			},
+		},
+	)
+	subtitle := "You'll see what will change before anything is saved."
+	if len(problems) > 0 {
+		subtitle = "Please fix the problems below."
+	}
+	return &suit.ConfigurationScreen{
+		Title:    "Import Config",
+		Subtitle: subtitle,
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "list",
+			},
+			suit.ReplyAction{
+				Label:        "Preview",
+				Name:         "previewImport",
+				DisplayClass: "success",
+				DisplayIcon:  "eye",
+			},
+		},
+	}, nil
+}
+
+// importPreview is a config screen listing what an import will change, to confirm before it's applied
+func (c *configService) importPreview(config, mode string, changes []string) (*suit.ConfigurationScreen, error) {
+	contents := []suit.Typed{
+		suit.InputHidden{
+			Name:  "config",
+			Value: config,
+		},
+		suit.InputHidden{
+			Name:  "mode",
+			Value: mode,
+		},
+	}
+	for _, change := range changes {
+		contents = append(contents, suit.StaticText{
+			Title: change,
+		})
+	}
+	return &suit.ConfigurationScreen{
+		Title:    "Import Config - Preview",
+		Subtitle: "Importing will make these changes.",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Back",
+				Name:  "import",
+			},
+			suit.ReplyAction{
+				Label:        "Import",
+				Name:         "applyImport",
+				DisplayClass: "warning",
+				DisplayIcon:  "check",
+			},
+		},
+	}, nil
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"math"
+	"sync"
 
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
 	"github.com/lindsaymarkward/go-avr-yamaha"
 	"github.com/lindsaymarkward/go-ninja/devices"
 	"github.com/ninjasphere/go-ninja/channels"
@@ -11,18 +15,199 @@ import (
 
 type Device struct {
 	devices.MediaPlayerDevice
-	avr *avryamaha.AVR
+	driver    *Driver
+	config    *AVRConfig // shared with the config screens, read it with settings
+	client    *client
+	ctx       context.Context // cancelled when the device is deleted or the driver stops
+	stop      context.CancelFunc
+	browsing  browseState // menu entries selected while browsing, used to bookmark favourites
+	health    connectionHealth
+	events    eventSubscription
+	pollNow   chan struct{} // wakes the poller early, e.g. when the AVR sends an event
+	published publishedState
+	sink      stateSink // where published states go, the MediaPlayerDevice
+	status    statusCache
+	toggling  sync.Mutex // toggles are read-then-set, so two at once would both set the same state
+}
+
+// settings returns a copy of the AVR's config, as the config screens can change it at any time
+func (d *Device) settings() AVRConfig {
+	return d.driver.snapshot(d.config)
+}
+
+// updateNow asks the poller to update the device's states straight away (without blocking)
+func (d *Device) updateNow() {
+	select {
+	case d.pollNow <- struct{}{}:
+	default:
+		// an update is already pending
+	}
+}
+
+// setPower turns a zone on or off and records it in the status cache
+func (d *Device) setPower(ctx context.Context, on bool, zone int) error {
+	if err := d.client.SetPower(ctx, on, zone); err != nil {
+		return err
+	}
+	d.status.update(zone, func(status *ync.ZoneStatus) { status.Power = on })
+	return nil
+}
+
+// setInput selects the input for a zone and records it in the status cache
+func (d *Device) setInput(ctx context.Context, input string, zone int) error {
+	if err := d.client.SetInput(ctx, input, zone); err != nil {
+		return err
+	}
+	d.status.update(zone, func(status *ync.ZoneStatus) { status.Input = input })
+	return nil
+}
+
+// setSoundProgram selects the DSP program for a zone and records it in the status cache
+func (d *Device) setSoundProgram(ctx context.Context, program string, zone int) error {
+	if err := d.client.SetSoundProgram(ctx, program, zone); err != nil {
+		return err
+	}
+	d.status.update(zone, func(status *ync.ZoneStatus) { status.SoundProgram = program })
+	return nil
+}
+
+// togglePower turns a zone on if it's off and vice versa, based on the AVR's current state rather than
+// the cache, then reads the state back to check it changed and publishes whatever the AVR reports
+func (d *Device) togglePower(ctx context.Context, zone int) (bool, error) {
+	d.toggling.Lock()
+	defer d.toggling.Unlock()
+
+	on, err := d.client.TogglePower(ctx, zone)
+	if err != nil {
+		return false, err
+	}
+	return d.confirmPower(ctx, zone, "togglePower", on)
+}
+
+// toggleMuted mutes a zone if it's unmuted and vice versa, checking it worked like togglePower
+func (d *Device) toggleMuted(ctx context.Context, zone int) (bool, error) {
+	d.toggling.Lock()
+	defer d.toggling.Unlock()
+
+	muted, err := d.client.ToggleMuted(ctx, zone)
+	if err != nil {
+		return false, err
+	}
+	status, err := d.confirm(ctx, zone, "toggleMuted", muted, true, func(status ync.ZoneStatus) interface{} { return status.Muted })
+	if status == nil {
+		// the command worked but couldn't be read back, so go with what it should have done
+		status, err = &ync.ZoneStatus{Muted: muted}, nil
+	}
+	if zone == d.settings().Zone {
+		d.publishVolume(&channels.VolumeState{Muted: &status.Muted}, true)
+	}
+	return status.Muted, err
+}
+
+// setMuted mutes or unmutes a zone, then reads the state back and publishes whatever the AVR reports
+func (d *Device) setMuted(ctx context.Context, muted bool, zone int) error {
+	if err := d.client.SetMuted(ctx, muted, zone); err != nil {
+		return err
+	}
+	status, err := d.confirm(ctx, zone, "setMuted", muted, true, func(status ync.ZoneStatus) interface{} { return status.Muted })
+	if status == nil {
+		status, err = &ync.ZoneStatus{Muted: muted}, nil
+	}
+	if zone == d.settings().Zone {
+		d.publishVolume(&channels.VolumeState{Muted: &status.Muted}, true)
+	}
+	return err
+}
+
+// switchPower turns a zone on or off, then reads the state back and publishes whatever the AVR reports
+func (d *Device) switchPower(ctx context.Context, on bool, zone int) error {
+	if err := d.setPower(ctx, on, zone); err != nil {
+		return err
+	}
+	_, err := d.confirmPower(ctx, zone, "setPower", on)
+	return err
+}
+
+// confirmPower checks a zone's power after a command and publishes it (if it's the selected zone)
+func (d *Device) confirmPower(ctx context.Context, zone int, command string, on bool) (bool, error) {
+	status, err := d.confirm(ctx, zone, command, on, true, func(status ync.ZoneStatus) interface{} { return status.Power })
+	if status == nil {
+		status, err = &ync.ZoneStatus{Power: on}, nil
+	}
+	if zone == d.settings().Zone {
+		d.publishOnOff(status.Power, true)
+	}
+	return status.Power, err
+}
+
+// setVolume sets a zone's volume (in dB), then reads it back and publishes whatever the AVR reports
+func (d *Device) setVolume(ctx context.Context, volume float64, zone int) error {
+	if err := d.client.SetVolume(ctx, int(volume*10), zone); err != nil {
+		return err
+	}
+	d.status.update(zone, func(status *ync.ZoneStatus) { status.Volume = volume })
+	d.confirmVolume(ctx, zone, "setVolume", volume)
+	return nil
+}
+
+// setVolumeLevel sets a zone's volume from a level in the range 0-1 (minimum to the configured maximum)
+// as used by Ninja, returning the level actually used
+func (d *Device) setVolumeLevel(ctx context.Context, level float64, zone int) (float64, error) {
+	// on my RX-V671 AVR, zone 2, min volume is -805 (-80.5 dB), max is 165 (+16.5 dB)
+	level = math.Max(0, math.Min(level, 1))
+	volumeRange := d.settings().MaxVolume - avryamaha.MinVolume
+	volume := (level * volumeRange) + avryamaha.MinVolume
+	// clamp volume to multiples of 0.5 to match AVR requirements
+	return level, d.setVolume(ctx, ync.ConformToClosest(volume, 0.5), zone)
+}
+
+// confirmVolume checks a zone's volume after a command and publishes it (if it's the selected zone)
+// a different volume isn't treated as a failure, as a later change may have replaced this one in the queue
+func (d *Device) confirmVolume(ctx context.Context, zone int, command string, volume float64) {
+	status, _ := d.confirm(ctx, zone, command, volume, false, func(status ync.ZoneStatus) interface{} { return status.Volume })
+	if status != nil {
+		volume = status.Volume
+	}
+	if settings := d.settings(); zone == settings.Zone {
+		level := volumeLevel(&settings, volume)
+		d.publishVolume(&channels.VolumeState{Level: &level}, true)
+	}
+}
+
+// confirm reads a zone's status back from the AVR after a command, updating the cache with it,
+// and returns an error if the AVR's state (from got) isn't what the command wanted, which is logged as
+// a warning if warn is set (otherwise at debug, for commands a later one may have replaced)
+// the status is nil only if it couldn't be read
+func (d *Device) confirm(ctx context.Context, zone int, command string, want interface{}, warn bool, got func(ync.ZoneStatus) interface{}) (*ync.ZoneStatus, error) {
+	status, err := d.client.ReadStatus(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	d.status.update(zone, func(cached *ync.ZoneStatus) { *cached = status })
+	settings := d.settings()
+	logFor(&settings).zone(zone).op(command).with("want", want).Debugf("Command confirmed")
+	if actual := got(status); actual != want {
+		logger := logFor(&settings).zone(zone).op(command).with("want", want).with("got", actual)
+		if warn {
+			logger.Warningf("AVR disagrees with command")
+		} else {
+			logger.Debugf("AVR disagrees with command")
+		}
+		return &status, fmt.Errorf("%s didn't take effect on zone %d (AVR reports %v)", command, zone, actual)
+	}
+	return &status, nil
 }
 
 // makeNewDevice creates a Ninja Sphere Media Player device and
 // sets all of the functions to handle events for play/pause/volume/power...
 func makeNewDevice(driver *Driver, cfg *AVRConfig) (*Device, error) {
-	log.Infof("Making new device for %v AVR with serial number %v at IP %v\n", cfg.Model, cfg.ID, cfg.IP)
+	logFor(cfg).op("createDevice").with("model", cfg.Model).Infof("Making new device")
 
+	name := cfg.Name
 	player, err := devices.CreateMediaPlayerDevice(driver, &model.Device{
 		NaturalID:     cfg.ID, // serial number
 		NaturalIDType: "yamaha-avr",
-		Name:          &cfg.Name,
+		Name:          &name,
 		Signatures: &map[string]string{
 			"ninja:manufacturer": "Yamaha",
 			"ninja:productName":  "Yamaha " + cfg.Model,
@@ -36,75 +221,66 @@ func makeNewDevice(driver *Driver, cfg *AVRConfig) (*Device, error) {
 		return nil, err
 	}
 
-	avr := avryamaha.AVR{IP: cfg.IP}
-	// no need to set serial (ID) & name as this is just so we can access the avryamah (YNC) library
+	// no need to set serial (ID) & name as the client is just so we can access the avryamaha (YNC) library
 	// those are all stored in the driver config
+	avr := newClient(cfg.IP, cfg.timeout())
 
-	player.ApplyIsOn = func() (bool, error) {
-		return avr.GetPower(cfg.Zone)
-	}
+	// the handlers publish through device so the poller knows what Ninja has already been sent
+	// (the player is copied into it once all the handlers are set)
+	// Ninja doesn't give handlers a context, so their calls are cancelled when the device stops
+	// cfg can change while the device runs, so the handlers read it with device.settings
+	device := &Device{driver: driver, config: cfg, client: avr, pollNow: make(chan struct{}, 1)}
+	device.ctx, device.stop = context.WithCancel(driver.ctx)
+	ctx := device.ctx
+	go avr.Run(device.ctx)
 
-	player.ApplyGetPower = func() (bool, error) {
-		return avr.GetPower(cfg.Zone)
+	// NOTE: every YNC model has power, volume and mute in each of its zones, which is all these channels use,
+	// so none of them depend on cfg.Capabilities - DSP programs and tuner bands, which do, have no Ninja
+	// channel and are only offered where the capabilities allow (control screen, API and MQTT)
+
+	// power comes from the poller's cache when it has read the zone, so this doesn't need an HTTP request
+	getPower := func() (bool, error) {
+		zone := device.settings().Zone
+		if status, ok := device.status.Zone(zone); ok {
+			return status.Power, nil
+		}
+		return avr.GetPower(ctx, zone)
 	}
+	player.ApplyIsOn = getPower
+	player.ApplyGetPower = getPower
 
 	// Volume Channel
-	player.ApplyVolumeUp = func() error {
-		err := avr.ChangeVolume(cfg.VolumeIncrement, cfg.Zone)
+	// these are only used if ApplyVolume isn't defined, but keep them working (see VolumeIncrement in configuration)
+	// every handler publishes state only once the AVR has accepted the command, and then
+	// it's the state read back from the AVR
+	changeVolume := func(direction float64) error {
+		settings := device.settings()
+		volume, err := avr.ChangeVolume(ctx, direction*settings.VolumeIncrement, settings.MaxVolume, settings.Zone)
 		if err != nil {
 			return err
 		}
-		newVolume, getError := avr.GetVolume(cfg.Zone)
-		if getError == nil {
-			player.UpdateVolumeState(&channels.VolumeState{
-				Level: &newVolume, // float64
-			})
-		}
-		return getError
+		device.status.update(settings.Zone, func(status *ync.ZoneStatus) { status.Volume = volume })
+		device.confirmVolume(ctx, settings.Zone, "changeVolume", volume)
+		return nil
+	}
+
+	player.ApplyVolumeUp = func() error {
+		return changeVolume(1)
 	}
 
 	player.ApplyVolumeDown = func() error {
-		err := avr.ChangeVolume(-cfg.VolumeIncrement, cfg.Zone)
-		if err != nil {
-			return err
-		}
-		newVolume, getError := avr.GetVolume(cfg.Zone)
-		if getError == nil {
-			player.UpdateVolumeState(&channels.VolumeState{
-				Level: &newVolume, // float64
-			})
-		}
-		return getError
+		return changeVolume(-1)
 	}
 
 	player.ApplyVolume = func(state *channels.VolumeState) error {
-		// translate volume in range 0-1 to Min-Max
-		// on my RX-V671 AVR, zone 2, min volume is -805 (-80.5 dB), max is 165 (+16.5 dB)
-		value := *state.Level
-		if value < 0 {
-			value = 0
-			state.Level = &value
-		} else if value > 1 {
-			value = 1
-			state.Level = &value
-		}
-
-		volumeRange := cfg.MaxVolume - avryamaha.MinVolume
-		volume := (value * volumeRange) + avryamaha.MinVolume
-		// clamp volume to multiples of 0.5 to match AVR requirements
-		volumeValue := int(conformToClosest(volume, 0.5) * 10)
-		//		log.Infof("volumeRange %v, volume %v, volumeValue %v\n", volumeRange, volume, volumeValue)
-		err := avr.SetVolume(volumeValue, cfg.Zone)
-		if err != nil {
-			return err // ?? an err here crashes the driver (does it still?). Perhaps we can make it more robust
-		}
-		player.UpdateVolumeState(state)
-		return nil
+		level, err := device.setVolumeLevel(ctx, *state.Level, device.settings().Zone)
+		state.Level = &level
+		return err
 	}
 
+	// toggles publish the state the AVR reports afterwards, so a tap always does what the AVR shows
 	player.ApplyToggleMuted = func() error {
-		state, err := avr.ToggleMuted(cfg.Zone)
-		player.UpdateVolumeState(&channels.VolumeState{Muted: &state})
+		_, err := device.toggleMuted(ctx, device.settings().Zone)
 		return err
 	}
 
@@ -115,18 +291,15 @@ func makeNewDevice(driver *Driver, cfg *AVRConfig) (*Device, error) {
 
 	// on-off channel methods
 	player.ApplyOff = func() error {
-		player.UpdateOnOffState(false)
-		return avr.SetPower(false, cfg.Zone)
+		return device.switchPower(ctx, false, device.settings().Zone)
 	}
 
 	player.ApplyOn = func() error {
-		player.UpdateOnOffState(true)
-		return avr.SetPower(true, cfg.Zone)
+		return device.switchPower(ctx, true, device.settings().Zone)
 	}
 
 	player.ApplyToggleOnOff = func() error {
-		state, err := avr.TogglePower(cfg.Zone)
-		player.UpdateOnOffState(state)
+		_, err := device.togglePower(ctx, device.settings().Zone)
 		return err
 	}
 
@@ -147,34 +320,33 @@ func makeNewDevice(driver *Driver, cfg *AVRConfig) (*Device, error) {
 
 	// NOTE: this is a workaround to get on/off when dragging to on/play or off/pause. Find a better way if possible
 	// https://discuss.ninjablocks.com/t/mediaplayer-device-drivers/3776/2 (question asked)
+	// the play/pause state is shown straight away (so the control doesn't jump back) and put back if it fails
 	player.ApplyPlayPause = func(isPlay bool) error {
+		player.UpdatePowerPlay(isPlay)
+		var err error
 		if isPlay {
-			player.UpdateControlState(channels.MediaControlEventPlaying)
-			return player.ApplyOn()
+			err = player.ApplyOn()
 		} else {
-			player.UpdateControlState(channels.MediaControlEventPaused)
-			return player.ApplyOff()
+			err = player.ApplyOff()
+		}
+		if err != nil {
+			on, _ := getPower()
+			player.UpdatePowerPlay(on)
 		}
+		return err
 	}
 
 	if err := player.EnableControlChannel([]string{}); err != nil {
 		player.Log().Errorf("Failed to enable control channel: %s", err)
 	}
 
-	return &Device{*player, &avr}, nil
-}
-
-func roundPlaces(f float64, places int) float64 {
-	shift := math.Pow(10, float64(places))
-	return round(f*shift) / shift
-}
-
-func round(f float64) float64 {
-	return math.Floor(f + .5)
+	device.MediaPlayerDevice = *player
+	device.sink = &device.MediaPlayerDevice
+	return device, nil
 }
 
-func conformToClosest(value, step float64) float64 {
-	multiples := int(value / step)
-	newValue := float64(multiples) * step
-	return roundPlaces(newValue, 2)
+// volumeLevel converts a volume in dB to the range 0-1 (minimum to the AVR's configured maximum) used by Ninja
+func volumeLevel(cfg *AVRConfig, volume float64) float64 {
+	volumeRange := cfg.MaxVolume - avryamaha.MinVolume
+	return (volume - avryamaha.MinVolume) / volumeRange
 }
@@ -0,0 +1,123 @@
+package main
+
+// diagnostics: whether the driver and each AVR are working, for monitoring (over Ninja RPC)
+// and the Diagnostics config screen
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Health describes the driver and every AVR it knows about
+type Health struct {
+	Healthy bool        `json:"healthy"` // every AVR is running and reachable
+	Started time.Time   `json:"started"`
+	Uptime  float64     `json:"uptime"` // seconds since the driver started
+	Events  bool        `json:"events"` // whether the driver is listening for AVR events (otherwise it only polls)
+	AVRs    []AVRHealth `json:"avrs"`
+	Pending []AVRHealth `json:"pending,omitempty"` // AVRs waiting to connect for the first time
+}
+
+// AVRHealth describes how an AVR is doing
+type AVRHealth struct {
+	ID           string            `json:"id,omitempty"`
+	Name         string            `json:"name"`
+	IP           string            `json:"ip"`
+	Model        string            `json:"model,omitempty"`    // from the AVR's details (GetXMLData)
+	Firmware     string            `json:"firmware,omitempty"` // from the AVR's System Config, read each time its device starts
+	Running      bool              `json:"running"`            // false if its device couldn't be created
+	Reachable    bool              `json:"reachable"`
+	OfflineSince time.Time         `json:"offlineSince"` // times are zero if they haven't happened
+	LastPoll     time.Time         `json:"lastPoll"`     // the last successful poll
+	LastError    string            `json:"lastError,omitempty"`
+	LastErrorAt  time.Time         `json:"lastErrorAt"`
+	Polls        uint64            `json:"polls"`
+	PollFailures uint64            `json:"pollFailures"`
+	ZoneErrors   map[string]string `json:"zoneErrors,omitempty"` // zones (other than the selected one) the last poll couldn't read
+	Events       bool              `json:"events"`               // whether the AVR sends events
+}
+
+// health describes the driver and its AVRs (just the AVR with id if it's set)
+// the caller holds configLock
+func (d *Driver) health(id string) (*Health, error) {
+	health := &Health{
+		Healthy: true,
+		Started: d.started,
+		Uptime:  time.Since(d.started).Seconds(),
+		Events:  d.eventPort != 0,
+		AVRs:    []AVRHealth{},
+	}
+	if id != "" {
+		if _, ok := d.config.AVRs[id]; !ok {
+			return nil, fmt.Errorf("Could not find AVR with id: %s", id)
+		}
+	}
+
+	for _, config := range d.config.AVRs {
+		if id != "" && config.ID != id {
+			continue
+		}
+		avr := AVRHealth{
+			ID:       config.ID,
+			Name:     config.Name,
+			IP:       config.IP,
+			Model:    config.Model,
+			Firmware: config.Capabilities.Firmware,
+		}
+		if device, ok := d.devices[config.ID]; ok {
+			offline, since := device.health.Offline()
+			avr.Running = true
+			avr.Reachable = !offline
+			if offline {
+				avr.OfflineSince = since
+			}
+			avr.LastPoll = device.health.LastSuccess()
+			if at, err := device.health.LastFailure(); err != nil {
+				avr.LastError, avr.LastErrorAt = err.Error(), at
+			}
+			avr.Polls, avr.PollFailures = device.health.Polls()
+			for zone, err := range device.status.ZoneErrors() {
+				if avr.ZoneErrors == nil {
+					avr.ZoneErrors = make(map[string]string)
+				}
+				avr.ZoneErrors[strconv.Itoa(zone)] = err.Error()
+			}
+			avr.Events = device.events.Active()
+		}
+		health.Healthy = health.Healthy && avr.Running && avr.Reachable
+		health.AVRs = append(health.AVRs, avr)
+	}
+	sort.Slice(health.AVRs, func(i, j int) bool { return health.AVRs[i].Name < health.AVRs[j].Name })
+
+	if id == "" {
+		for ip, config := range d.config.Pending {
+			health.Pending = append(health.Pending, AVRHealth{Name: config.Name, IP: ip})
+		}
+		sort.Slice(health.Pending, func(i, j int) bool { return health.Pending[i].IP < health.Pending[j].IP })
+	}
+	return health, nil
+}
+
+// healthService is exported over Ninja RPC so monitoring can check the driver is working
+type healthService struct {
+	driver *Driver
+}
+
+// a HealthRequest optionally limits the health to one AVR (serial number)
+type HealthRequest struct {
+	AVR string `json:"avr,omitempty"`
+}
+
+// GetHealth returns the health of the driver and its AVRs, from what the pollers last saw
+// it doesn't ask the AVRs, and only waits for configLock, which isn't held while anything talks to an AVR
+func (s *healthService) GetHealth(request *HealthRequest) (*Health, error) {
+	s.driver.configLock.Lock()
+	defer s.driver.configLock.Unlock()
+	id := ""
+	if request != nil {
+		id = request.AVR
+	}
+	return s.driver.health(id)
+}
@@ -5,10 +5,15 @@ package main
 // Lindsay Ward, June 2015 - https://github.com/lindsaymarkward/driver-avr-yamaha
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
 	"time"
 
 	"fmt"
 
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
 	"github.com/lindsaymarkward/go-avr-yamaha"
 	"github.com/ninjasphere/go-ninja/api"
 	"github.com/ninjasphere/go-ninja/channels"
@@ -19,27 +24,82 @@ import (
 
 const defaultUpdateInterval = 5
 
+// requestTimeout limits how long a configuration screen or RPC request can spend talking to AVRs
+// (individual calls are limited by each AVR's own timeout)
+const requestTimeout = 30 * time.Second
+
 var info = ninja.LoadModuleInfo("./package.json")
-var log = logger.GetLogger(info.Name)
+var log = driverLogger{logger.GetLogger(info.Name)}
 
 type Driver struct {
 	support.DriverSupport
-	config  Config
-	devices map[string]*Device
+	config    Config
+	devices   map[string]*Device
+	eventPort int             // 0 if we couldn't listen for AVR events
+	started   time.Time       // for the driver uptime in health
+	ctx       context.Context // cancelled when the driver stops
+	stop      context.CancelFunc
+	// configLock is held while the AVRs and Pending maps are used from outside the driver's own
+	// goroutines (config screens, RPC, events) as pending AVRs can be added at any time
+	configLock sync.Mutex
+	// avrLock guards the fields of each AVRConfig, which the pollers, devices, API and MQTT bridge read
+	// without configLock - they're changed holding both, and read with snapshot
+	avrLock     sync.RWMutex
+	api         *apiServer         // nil unless the API is turned on in settings
+	stopAPI     context.CancelFunc // ends the goroutine that closes api when the driver stops
+	mqtt        *mqttBridge
+	metrics     *http.Server       // nil unless metrics are turned on in settings
+	stopMetrics context.CancelFunc // like stopAPI, for metrics
 }
 
+// Config is everything Ninja saves for the driver, older versions are migrated when it's loaded (see migrate.go)
 type Config struct {
-	AVRs map[string]*AVRConfig
+	Version    int `json:"version,string"`
+	AVRs       map[string]*AVRConfig
+	Pending    map[string]*AVRConfig `json:",omitempty"`           // AVRs waiting to connect for the first time, by IP
+	Unmigrated json.RawMessage       `json:"unmigrated,omitempty"` // the original config if it couldn't be migrated
+	API        APIConfig             `json:"api"`
+	MQTT       MQTTConfig            `json:"mqtt"`
+	Metrics    MetricsConfig         `json:"metrics"`
 }
 
 // an AVRConfig stores details about an AV Receiver including reference to the ync library's AVR struct
 type AVRConfig struct {
-	avryamaha.AVR           // IP, ID, Name
-	VolumeIncrement float64 `json:"volumeIncrement,string,omitempty"`
-	MaxVolume       float64 `json:"maxVolume,string,omitempty"`
-	Zones           int     `json:"zones,string,omitempty"`
-	Zone            int     `json:"zone,string,omitempty"`
-	UpdateInterval  int     `json:"updateInterval,string,omitempty"`
+	avryamaha.AVR                // IP, ID, Name
+	VolumeIncrement float64      `json:"volumeIncrement,string,omitempty"`
+	MaxVolume       float64      `json:"maxVolume,string,omitempty"`
+	Zones           int          `json:"zones,string,omitempty"`         // detected from the AVR unless overridden
+	ZonesOverride   int          `json:"zonesOverride,string,omitempty"` // set on the edit form, 0 to detect
+	Zone            int          `json:"zone,string,omitempty"`
+	UpdateInterval  int          `json:"updateInterval,string,omitempty"`
+	Timeout         float64      `json:"timeout,string,omitempty"` // seconds to wait for each request
+	Favourites      []Favourite  `json:"favourites,omitempty"`
+	Capabilities    Capabilities `json:"capabilities"`
+	LogLevel        string       `json:"logLevel,omitempty"` // one of logLevels, blank for defaultLogLevel
+}
+
+// timeout returns how long to wait for each request to the AVR
+func (c *AVRConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return ync.DefaultTimeout
+	}
+	return time.Duration(c.Timeout * float64(time.Second))
+}
+
+// snapshot returns a copy of an AVR's config that can be used without holding any lock
+// (favourites and capabilities are replaced rather than changed in place, so the copy's slices don't change)
+func (d *Driver) snapshot(config *AVRConfig) AVRConfig {
+	d.avrLock.RLock()
+	defer d.avrLock.RUnlock()
+	return *config
+}
+
+// updateAVR changes an AVR's config where readers without configLock could see it
+// the caller holds configLock
+func (d *Driver) updateAVR(config *AVRConfig, update func(config *AVRConfig)) {
+	d.avrLock.Lock()
+	defer d.avrLock.Unlock()
+	update(config)
 }
 
 // NewDriver creates a new driver with an empty map of names
@@ -48,6 +108,12 @@ func NewDriver() (*Driver, error) {
 	driver := &Driver{
 		devices: make(map[string]*Device),
 	}
+	driver.ctx, driver.stop = context.WithCancel(context.Background())
+	driver.mqtt = newMQTTBridge(driver)
+
+	// go-avr-yamaha uses the default client and can't be cancelled, so make sure
+	// abandoned library calls (see ync.Client) finish eventually
+	http.DefaultClient.Timeout = requestTimeout
 
 	err := driver.Init(info)
 	if err != nil {
@@ -65,92 +131,331 @@ func NewDriver() (*Driver, error) {
 // Start runs when the driver is started - called by the Ninja system (not the driver itself),
 // creates devices for all AVRs in the config, exports the configuration service
 func (d *Driver) Start(config *Config) error {
-	log.Infof("Driver starting with config %+v", config)
+	d.started = time.Now()
+	log.Infof("Driver starting with config version %d, %d AVRs and %d waiting to connect", config.Version, len(config.AVRs), len(config.Pending))
 
 	if config.AVRs == nil {
 		config.AVRs = make(map[string]*AVRConfig)
 	}
+	if config.Pending == nil {
+		config.Pending = make(map[string]*AVRConfig)
+	}
+
+	if config.Unmigrated != nil {
+		log.Warningf("Config is from an older version and couldn't be migrated, the original is kept as \"unmigrated\" in the config")
+	} else if config.Version == 0 {
+		// there was no config to migrate (a new install), so it's already the current version
+		config.Version = configVersion
+	}
 
 	d.config = *config
 
+	// listen for events before creating devices so they can subscribe straight away
+	port, err := d.listenForEvents()
+	if err != nil {
+		log.Warningf("Could not listen for AVR events, using polling only: %s", err)
+	}
+	d.eventPort = port
+
+	// events are already arriving, and handleEvent looks up devices under configLock
+	d.configLock.Lock()
 	for _, cfg := range config.AVRs {
 		d.createAVRDevice(cfg)
 	}
+	d.configLock.Unlock()
+	go d.watchPending()
+
+	// the API is optional, so the driver still starts without it
+	if err := d.startAPI(); err != nil {
+		log.Errorf("%s", err)
+	}
+	if err := d.startMQTT(); err != nil {
+		log.Errorf("%s", err)
+	}
+	if err := d.startMetrics(); err != nil {
+		log.Errorf("%s", err)
+	}
 
 	d.Conn.MustExportService(&configService{d}, "$driver/"+info.ID+"/configure", &model.ServiceAnnouncement{
 		Schema: "/protocol/configuration",
 	})
 
+	d.Conn.MustExportService(&favouritesService{d}, "$driver/"+info.ID+"/favourites", &model.ServiceAnnouncement{
+		Schema: "/service/yamaha-avr/favourites",
+	})
+
+	d.Conn.MustExportService(&healthService{d}, "$driver/"+info.ID+"/health", &model.ServiceAnnouncement{
+		Schema: "/service/yamaha-avr/health",
+	})
+
 	return nil
 }
 
-// UpdateStates updates all relevant states in the driver to account for external changes to the AVR
-func (d *Driver) UpdateStates(device *Device, config *AVRConfig) error {
-	// set current states
-	state, err := device.avr.GetState(config.Zone)
+// Stop is called by the Ninja system when the driver is stopped, it cancels all pollers and requests
+func (d *Driver) Stop() error {
+	d.stop()
+	return nil
+}
+
+// SendEvent sends an event (in practice the config, to save it) to Ninja, without a connection
+// (a driver made in tests) there's nothing to send it to
+func (d *Driver) SendEvent(event string, payload interface{}) error {
+	if d.Conn == nil {
+		return nil
+	}
+	return d.DriverSupport.SendEvent(event, payload)
+}
+
+// UpdateStates reads the status of every zone on the AVR into the device's cache,
+// publishes any changes in the selected zone's states to Ninja and every zone to the MQTT bridge
+// it only fails if the selected zone can't be read (that's what Ninja shows), other zones' errors are
+// kept in the cache (see statusCache.ZoneErrors) and logged when they start and stop
+func (d *Driver) UpdateStates(ctx context.Context, device *Device, config *AVRConfig) error {
+	if config.Zone < 1 || config.Zone > config.Zones && config.Zone != 1 {
+		return fmt.Errorf("AVR %s has no zone %d", config.Name, config.Zone)
+	}
+	// the selected zone first, if it can't be read the AVR is most likely unreachable
+	state, err := device.client.ZoneStatus(ctx, config.Zone)
 	if err != nil {
 		return err
 	}
+	zones := map[int]ync.ZoneStatus{config.Zone: state}
+	failed := make(map[int]error)
+	for zone := 1; zone <= config.Zones; zone++ {
+		if zone == config.Zone {
+			continue
+		}
+		status, err := device.client.ZoneStatus(ctx, zone)
+		if err != nil {
+			failed[zone] = err
+			continue
+		}
+		zones[zone] = status
+	}
+	previous := device.status.set(zones, failed)
+	for zone, err := range failed {
+		if _, was := previous[zone]; !was {
+			logFor(config).zone(zone).op("poll").with("error", err).Warningf("Could not read zone")
+		}
+	}
+	for zone := range previous {
+		if _, still := failed[zone]; !still {
+			logFor(config).zone(zone).op("poll").Infof("Zone can be read again")
+		}
+	}
+	logFor(config).op("poll").with("zones", len(zones)).with("failed", len(failed)).Debugf("Polled AVR")
+	d.mqtt.publishStates(config, zones)
+
 	// convert YNC volume value to float in range 0-1
-	volumeRange := config.MaxVolume - avryamaha.MinVolume
-	volumeFloat := (state.Volume - avryamaha.MinVolume) / volumeRange
+	volumeFloat := volumeLevel(config, state.Volume)
 
-	device.UpdateVolumeState(&channels.VolumeState{Level: &volumeFloat, Muted: &state.Muted})
-	device.UpdateOnOffState(state.Power)
+	// only send states that changed, apart from an occasional full refresh
+	force := device.published.refreshDue(config.Zone)
+	device.publishVolume(&channels.VolumeState{Level: &volumeFloat, Muted: &state.Muted}, force)
+	device.publishOnOff(state.Power, force)
 	return nil
 }
 
+// poll updates the device's states and keeps track of whether the AVR is reachable,
+// logging only when it goes offline or comes back (not on every failed poll), and returns any error
+// the poller marks ctx with ync.PollPriority so its requests wait for user commands
+func (d *Driver) poll(ctx context.Context, device *Device, config *AVRConfig) error {
+	err := d.UpdateStates(ctx, device, config)
+	if ctx.Err() != nil {
+		// cancelled (not the AVR's fault), so don't count it against the AVR's health
+		return err
+	}
+	if !device.health.record(err) {
+		return err
+	}
+	d.mqtt.publishAvailability(config, err == nil)
+	if err != nil {
+		logFor(config).op("poll").with("error", err).Warningf("AVR is unreachable, backing off polling")
+	} else {
+		logFor(config).op("poll").Infof("AVR is back online")
+	}
+	return err
+}
+
 // createAVRDevice makes a new device from the config details passed in,
 // starts a function that regularly updates the driver states
 func (d *Driver) createAVRDevice(config *AVRConfig) error {
 
 	device, err := makeNewDevice(d, config)
 	if err != nil {
-		errorMsg := fmt.Errorf("Failed to create new Yamaha AVR device IP:%s ID:%s name:%s - %s", config.IP, config.ID, config.Name, err)
-		log.Errorf(fmt.Sprintf("%s", errorMsg))
-		return errorMsg
+		logFor(config).op("createDevice").with("error", err).Errorf("Failed to create device")
+		return fmt.Errorf("Failed to create new Yamaha AVR device IP:%s ID:%s name:%s - %s", config.IP, config.ID, config.Name, err)
 	}
 
 	if config.UpdateInterval == 0 {
 		config.UpdateInterval = defaultUpdateInterval
 	}
+	// zone isn't set until one is selected on the control screen, so start with the main zone
+	if config.Zone == 0 {
+		config.Zone = 1
+	}
 	// regular updates to sync states so Ninja sees updates made to AVR externally
+	// when the AVR sends events, polling is only a slow fallback and events trigger updates
+	// AVRs saved before capabilities were detected (or that were offline) are detected once they're reachable,
+	// the others just have their firmware read (it's the only part that changes)
 	go func() {
+		detect, firmware := !config.Capabilities.Detected, true
 		for {
-			if device != nil {
-				d.UpdateStates(device, config)
+			// the config screens can change the config at any time, so each poll uses a copy
+			settings := d.snapshot(config)
+			err := d.poll(ync.WithPriority(device.ctx, ync.PollPriority), device, &settings)
+			switch {
+			case err != nil:
+			case detect:
+				// until they're detected (e.g. a request timed out), the next poll tries again
+				firmware = false
+				detect = !d.updateCapabilities(ync.WithPriority(device.ctx, ync.PollPriority), device, config)
+			case firmware:
+				firmware = false
+				d.updateFirmware(ync.WithPriority(device.ctx, ync.PollPriority), device, config)
+			}
+			interval := time.Duration(settings.UpdateInterval) * time.Second
+			if device.events.Active() && interval < eventFallbackPoll {
+				interval = eventFallbackPoll
+			}
+			select {
+			case <-device.ctx.Done():
+				return
+			case <-device.pollNow:
+			case <-time.After(device.health.nextPoll(interval)):
 			}
-			time.Sleep(time.Duration(config.UpdateInterval) * time.Second)
 		}
 	}()
+	if d.eventPort != 0 {
+		go d.keepSubscribed(device, config, d.eventPort)
+	}
 
 	d.devices[config.ID] = device
-	log.Infof("Created device with ID %v at IP %v\n", config.ID, device.avr.IP)
+	logFor(config).op("createDevice").Infof("Created device")
 	return nil
 }
 
+// updateCapabilities detects an AVR's capabilities and saves them in its config, returning false if
+// they couldn't be read and should be tried again (the config keeps what it had)
+func (d *Driver) updateCapabilities(ctx context.Context, device *Device, config *AVRConfig) bool {
+	settings := d.snapshot(config)
+	capabilities, err := detectCapabilities(ctx, device.client, &settings)
+	if err != nil {
+		logFor(&settings).op("detectCapabilities").with("error", err).Warningf("Could not detect capabilities, showing every control")
+		return err == errNoFeatures
+	}
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	d.updateAVR(config, func(config *AVRConfig) { config.Capabilities = capabilities })
+	if err := d.SendEvent("config", d.config); err != nil {
+		logFor(config).op("detectCapabilities").with("error", err).Errorf("Failed to save capabilities")
+	}
+	return true
+}
+
+// updateFirmware reads the AVR's firmware version into its capabilities, as it can be upgraded after the
+// capabilities were detected, saving the config if it changed
+func (d *Driver) updateFirmware(ctx context.Context, device *Device, config *AVRConfig) {
+	system, err := device.client.SystemConfig(ctx)
+	if err != nil || system.Firmware == "" {
+		settings := d.snapshot(config)
+		logFor(&settings).op("readFirmware").with("error", err).Debugf("Could not read firmware version")
+		return
+	}
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	if config.Capabilities.Firmware == system.Firmware {
+		return
+	}
+	logFor(config).op("readFirmware").with("was", config.Capabilities.Firmware).with("firmware", system.Firmware).Infof("Firmware changed")
+	d.updateAVR(config, func(config *AVRConfig) { config.Capabilities.Firmware = system.Firmware })
+	if err := d.SendEvent("config", d.config); err != nil {
+		logFor(config).op("readFirmware").with("error", err).Errorf("Failed to save firmware version")
+	}
+}
+
 // saveAVR saves configuration set in configuration form (Labs)
-func (d *Driver) saveAVR(avr AVRConfig) error {
+// like tryPending, configLock is only held once the AVR has answered (or not), so an offline AVR
+// doesn't hold up everything else
+func (d *Driver) saveAVR(ctx context.Context, avr AVRConfig) error {
 	// read data from the amp's XML details using IP to see if it's online
-	err := avr.GetXMLData()
+	err := connect(ctx, &avr)
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
 	if err != nil {
-		errorMsg := fmt.Errorf("Could not connect to AVR (%v). Is it online?\n", err)
-		log.Errorf(fmt.Sprintf("%s", errorMsg))
-		// NOTE: could consider saving the config anyway (temp, don't "sendevent")
-		// so you don't have to re-enter everything, but seems we can't since we don't have an ID
-		return errorMsg
+		logFor(&avr).op("connect").with("error", err).Warningf("Could not connect to AVR")
+		// an AVR we already know can be saved as it is (keeping its zones unless they're overridden),
+		// a new one has no ID (serial number) yet so it waits to connect (see pending.go)
+		if _, ok := d.config.AVRs[avr.ID]; ok {
+			avr.Zones = avr.ZonesOverride
+			return d.storeAVR(avr)
+		}
+		return d.addPending(avr)
+	}
+	logFor(&avr).op("connect").with("model", avr.Model).Infof("Connected to AVR")
+	return d.storeAVR(avr)
+}
+
+// connect reads the AVR's details (model, ID) and capabilities, and its number of zones,
+// which is detected from its features unless the config overrides it
+func connect(ctx context.Context, avr *AVRConfig) error {
+	c := &client{ync.NewUnqueuedClient(&avr.AVR, avr.timeout())}
+	if err := c.GetXMLData(ctx); err != nil {
+		return err
+	}
+	capabilities, err := detectCapabilities(ctx, c, avr)
+	if err != nil {
+		logFor(avr).op("detectCapabilities").with("error", err).Warningf("Could not detect capabilities, showing every control")
+	}
+	avr.Capabilities = capabilities
+
+	avr.Zones = avr.ZonesOverride
+	if avr.Zones == 0 {
+		avr.Zones = capabilities.zones()
+	}
+	if avr.Zones == 0 {
+		// older models may not list their features, so assume just the main zone
+		logFor(avr).op("detectCapabilities").Warningf("Could not detect zones, using 1 (set zones on the edit form to change it)")
+		avr.Zones = 1
 	}
-	log.Infof("Got model: %v, at IP: %v\n", avr.Model, avr.ID)
+	return nil
+}
+
+// storeAVR adds an AVR (with its ID) to the config, or updates the one that's already there
+// the caller holds configLock
+func (d *Driver) storeAVR(avr AVRConfig) error {
+	// it's connected, so it's not waiting any more
+	delete(d.config.Pending, avr.IP)
 
 	// if AVR already exists in config, just update config; otherwise, create new device
-	_, ok := d.config.AVRs[avr.ID]
+	existing, ok := d.config.AVRs[avr.ID]
 	if ok {
 		// NOTE: here is where we could handle multiple devices for one AVR - multiple zones
 		// use a config option, check it here - if it's wanted, use serial number + zone as key
-		d.config.AVRs[avr.ID] = &avr
+		// update the existing config in place, as the device and poller use it, and only with the
+		// fields on the edit form (favourites, zone etc. aren't on it)
+		// NOTE: a new IP address isn't used until the driver restarts
+		d.updateAVR(existing, func(existing *AVRConfig) {
+			existing.Name = avr.Name
+			existing.IP = avr.IP
+			existing.ZonesOverride = avr.ZonesOverride
+			existing.LogLevel = avr.LogLevel
+			if avr.Zones > 0 {
+				existing.Zones = avr.Zones
+			}
+			existing.MaxVolume = avr.MaxVolume
+			existing.UpdateInterval = avr.UpdateInterval
+			existing.Timeout = avr.Timeout
+			if avr.Capabilities.Detected {
+				existing.Capabilities = avr.Capabilities
+			}
+			if existing.Zone > existing.Zones {
+				existing.Zone = 1
+			}
+		})
 	} else {
 		// new AVR - first-time setup, create device
-		if err = d.createAVRDevice(&avr); err != nil {
+		if err := d.createAVRDevice(&avr); err != nil {
 			return err
 		}
 		d.config.AVRs[avr.ID] = &avr
@@ -158,11 +463,55 @@ func (d *Driver) saveAVR(avr AVRConfig) error {
 	return d.SendEvent("config", d.config)
 }
 
+// saveSettings saves the settings from the settings screen (just the settings fields of settings are used)
+// and restarts anything that uses them
+// the caller holds configLock
+func (d *Driver) saveSettings(settings Config) error {
+	d.config.API = settings.API
+	d.config.MQTT = settings.MQTT
+	d.config.Metrics = settings.Metrics
+	if err := d.SendEvent("config", d.config); err != nil {
+		return err
+	}
+	if err := d.startAPI(); err != nil {
+		return err
+	}
+	if err := d.startMetrics(); err != nil {
+		return err
+	}
+	return d.startMQTT()
+}
+
+// lookupAVR finds an AVR's config (a copy, see snapshot) and device for the API and MQTT bridge,
+// holding configLock only while it looks
+func (d *Driver) lookupAVR(id string) (*AVRConfig, *Device, error) {
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	config, ok := d.config.AVRs[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("Could not find AVR with id: %s", id)
+	}
+	device, ok := d.devices[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("AVR %s (%s) has no device - try restarting the driver", config.Name, id)
+	}
+	settings := d.snapshot(config)
+	return &settings, device, nil
+}
+
 // deleteAVR deletes an AVR from the config map
+// the caller holds configLock
 // NOTE: we can't yet unexport a device, so...?
 func (d *Driver) deleteAVR(id string) error {
+	if config, ok := d.config.AVRs[id]; ok {
+		d.mqtt.remove(config)
+	}
 	delete(d.config.AVRs, id)
 	// not sure about deleting devices - doesn't actually delete the device unless we restart the driver...
+	// but at least stop it polling
+	if device, ok := d.devices[id]; ok {
+		device.stop()
+	}
 	delete(d.devices, id)
 
 	err := d.SendEvent("config", &d.config)
@@ -0,0 +1,167 @@
+package main
+
+// event notifications from newer (MusicCast) Yamaha receivers
+// a GET to the Extended Control API with X-AppName/X-AppPort headers subscribes us for 10 minutes,
+// during which the receiver sends a UDP packet of JSON to that port whenever something changes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lindsaymarkward/go-avr-yamaha"
+)
+
+const (
+	eventPort             = 41100            // UDP port we ask receivers to send events to
+	eventRenewInterval    = 5 * time.Minute  // receivers drop subscriptions after 10 minutes
+	eventSubscriptionTime = 10 * time.Minute // how long a subscription lasts
+	eventFallbackPoll     = 60 * time.Second // slowest polling interval while events are arriving
+)
+
+// eventZones maps the zone keys used in event notifications to zone numbers
+var eventZones = map[string]int{
+	"main":  1,
+	"zone2": 2,
+	"zone3": 3,
+	"zone4": 4,
+}
+
+// eventSubscription records whether an AVR is currently sending us events
+type eventSubscription struct {
+	sync.Mutex
+	expires time.Time
+}
+
+// Active returns true if the AVR accepted a subscription that hasn't yet expired
+func (s *eventSubscription) Active() bool {
+	s.Lock()
+	defer s.Unlock()
+	return time.Now().Before(s.expires)
+}
+
+func (s *eventSubscription) renewed() {
+	s.Lock()
+	defer s.Unlock()
+	s.expires = time.Now().Add(eventSubscriptionTime)
+}
+
+// subscribeEvents asks the AVR to send event notifications to port
+// older (non-MusicCast) receivers don't have the Extended Control API and return an error
+func (c *client) subscribeEvents(ctx context.Context, port int) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout())
+	defer cancel()
+	request, err := http.NewRequest("GET", "http://"+c.IP()+"/YamahaExtendedControl/v1/main/getStatus", nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-AppName", "MusicCast/1.0("+info.ID+")")
+	request.Header.Set("X-AppPort", strconv.Itoa(port))
+
+	resp, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("event subscription not supported (HTTP %d)", resp.StatusCode)
+	}
+	var status struct {
+		ResponseCode int `json:"response_code"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("event subscription not supported: %s", err)
+	}
+	if status.ResponseCode != 0 {
+		return fmt.Errorf("event subscription failed with response code %d", status.ResponseCode)
+	}
+	return nil
+}
+
+// listenForEvents receives event notifications from all AVRs and wakes the poller of the device
+// they came from, returns the port being listened on (until the driver stops)
+func (d *Driver) listenForEvents() (int, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: eventPort})
+	if err != nil {
+		return 0, err
+	}
+
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				if d.ctx.Err() == nil {
+					logOp("listenForEvents").with("error", err).Errorf("Stopped listening for AVR events")
+				}
+				return
+			}
+			d.handleEvent(addr.IP.String(), buffer[:n])
+		}
+	}()
+	go func() {
+		<-d.ctx.Done()
+		conn.Close()
+	}()
+	return eventPort, nil
+}
+
+// handleEvent triggers an immediate update of the device at ip if the event is about one of its zones
+func (d *Driver) handleEvent(ip string, data []byte) {
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	// events from an IP that isn't one of our AVRs are still logged with the IP
+	config := &AVRConfig{AVR: avryamaha.AVR{IP: ip}}
+	var device *Device
+	for id, avr := range d.config.AVRs {
+		if avr.IP == ip {
+			settings := d.snapshot(avr)
+			config, device = &settings, d.devices[id]
+			break
+		}
+	}
+
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(data, &event); err != nil {
+		logFor(config).op("event").with("error", err).Warningf("Ignoring invalid event")
+		return
+	}
+	if device == nil {
+		return
+	}
+	for key := range event {
+		if _, ok := eventZones[key]; ok {
+			logFor(config).op("event").with("zone", key).Debugf("Event received, updating")
+			device.updateNow()
+			return
+		}
+	}
+}
+
+// keepSubscribed subscribes to events from an AVR and renews the subscription before it expires
+// receivers that don't support events are retried at the same interval in case they're just offline
+func (d *Driver) keepSubscribed(device *Device, config *AVRConfig, port int) {
+	for {
+		settings := d.snapshot(config)
+		if err := device.client.subscribeEvents(device.ctx, port); err != nil {
+			if device.events.Active() {
+				logFor(&settings).op("subscribe").with("error", err).Warningf("Lost event subscription, falling back to polling")
+			}
+		} else {
+			if !device.events.Active() {
+				logFor(&settings).op("subscribe").Infof("Subscribed to events")
+			}
+			device.events.renewed()
+		}
+		select {
+		case <-device.ctx.Done():
+			return
+		case <-time.After(eventRenewInterval):
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+// favourites are per-AVR shortcuts to an input, optionally with a tuner preset or a bookmarked
+// NET RADIO/SERVER/USB menu path, that can be recalled from Labs or over Ninja RPC
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+)
+
+// a Favourite selects Input and then either tunes Preset (TUNER) or replays Path (browsable inputs)
+type Favourite struct {
+	Name   string   `json:"name"`
+	Input  string   `json:"input"`
+	Preset int      `json:"preset,omitempty"`
+	Path   []string `json:"path,omitempty"`
+}
+
+// Description is a short summary of what the favourite recalls, for display in lists
+func (f Favourite) Description() string {
+	switch {
+	case f.Preset > 0 && f.Input == "TUNER":
+		return fmt.Sprintf("%s preset %d", f.Input, f.Preset)
+	case len(f.Path) > 0:
+		return f.Input + " > " + f.Path[len(f.Path)-1]
+	default:
+		return f.Input
+	}
+}
+
+// setTunerPreset tunes the AVR's tuner to a stored preset number
+func (c *client) setTunerPreset(ctx context.Context, preset int) error {
+	return ync.Retry(ctx, func() error {
+		_, err := c.Request(ctx, "PUT", "<Tuner><Play_Control><Preset><Preset_Sel>"+strconv.Itoa(preset)+"</Preset_Sel></Preset></Play_Control></Tuner>")
+		return err
+	})
+}
+
+// addFavourite adds a favourite to an AVR and saves the config
+func (d *Driver) addFavourite(id string, favourite Favourite) error {
+	config, ok := d.config.AVRs[id]
+	if !ok {
+		return fmt.Errorf("Could not find AVR with id: %s", id)
+	}
+	if favourite.Name == "" || favourite.Input == "" {
+		return fmt.Errorf("A favourite needs a name and an input")
+	}
+	// favourites are played and deleted by name, so names can't be shared
+	if config.findFavourite(favourite.Name) >= 0 {
+		return fmt.Errorf("%s already has a favourite called %q", config.Name, favourite.Name)
+	}
+	// a new slice, so copies of the config (see snapshot) keep the favourites they had
+	favourites := append(append([]Favourite{}, config.Favourites...), favourite)
+	d.updateAVR(config, func(config *AVRConfig) { config.Favourites = favourites })
+	return d.SendEvent("config", d.config)
+}
+
+// deleteFavourite removes a favourite (by name) from an AVR and saves the config
+func (d *Driver) deleteFavourite(id, name string) error {
+	config, ok := d.config.AVRs[id]
+	if !ok {
+		return fmt.Errorf("Could not find AVR with id: %s", id)
+	}
+	index := config.findFavourite(name)
+	if index < 0 {
+		return fmt.Errorf("Could not find favourite %q for AVR %s", name, config.Name)
+	}
+	favourites := append(append([]Favourite{}, config.Favourites[:index]...), config.Favourites[index+1:]...)
+	d.updateAVR(config, func(config *AVRConfig) { config.Favourites = favourites })
+	return d.SendEvent("config", d.config)
+}
+
+// playFavourite powers on a zone (0 means the AVR's current zone), switches it to the favourite's input
+// and tunes the preset or replays the browsing path, returning the favourite played (found by name)
+// it uses a copy of the config (see lookupAVR), so configLock isn't held while talking to the AVR
+func (d *Driver) playFavourite(ctx context.Context, id, name string, zone int) (Favourite, error) {
+	config, device, err := d.lookupAVR(id)
+	if err != nil {
+		return Favourite{}, err
+	}
+	index := config.findFavourite(name)
+	if index < 0 {
+		return Favourite{}, fmt.Errorf("Could not find favourite %q for AVR %s", name, config.Name)
+	}
+	favourite := config.Favourites[index]
+	if zone == 0 {
+		zone = config.Zone
+	}
+	logFor(config).zone(zone).op("playFavourite").with("favourite", favourite.Name).with("description", favourite.Description()).Infof("Playing favourite")
+
+	if err := device.switchPower(ctx, true, zone); err != nil {
+		return favourite, err
+	}
+	if err := device.setInput(ctx, favourite.Input, zone); err != nil {
+		return favourite, err
+	}
+
+	switch {
+	case favourite.Preset > 0 && favourite.Input == "TUNER":
+		return favourite, device.client.setTunerPreset(ctx, favourite.Preset)
+	case len(favourite.Path) > 0:
+		if err := device.client.playPath(ctx, favourite.Input, favourite.Path); err != nil {
+			return favourite, err
+		}
+		device.browsing.replay(favourite.Input, favourite.Path)
+	}
+	return favourite, nil
+}
+
+// findFavourite returns the position of the AVR's favourite with the given name, or -1
+func (c *AVRConfig) findFavourite(name string) int {
+	for i, favourite := range c.Favourites {
+		if favourite.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// favouritesService is exported over Ninja RPC so favourites can be listed and recalled from outside Labs
+type favouritesService struct {
+	driver *Driver
+}
+
+// a FavouriteRequest identifies an AVR (serial number) and, for Play, the favourite and optional zone
+type FavouriteRequest struct {
+	AVR  string `json:"avr"`
+	Name string `json:"name,omitempty"`
+	Zone int    `json:"zone,omitempty"`
+}
+
+// GetFavourites returns the favourites stored for an AVR
+func (s *favouritesService) GetFavourites(request *FavouriteRequest) (*[]Favourite, error) {
+	s.driver.configLock.Lock()
+	defer s.driver.configLock.Unlock()
+	config, ok := s.driver.config.AVRs[request.AVR]
+	if !ok {
+		return nil, fmt.Errorf("Could not find AVR with id: %s", request.AVR)
+	}
+	favourites := append([]Favourite{}, config.Favourites...)
+	return &favourites, nil
+}
+
+// Play recalls a favourite by name, powering on the zone and tuning it
+// configLock isn't held while the AVR is tuned (see playFavourite)
+func (s *favouritesService) Play(request *FavouriteRequest) (*Favourite, error) {
+	// Ninja RPC calls don't carry a context, so give the whole recall (including browsing) a deadline
+	ctx, cancel := context.WithTimeout(s.driver.ctx, requestTimeout)
+	defer cancel()
+	favourite, err := s.driver.playFavourite(ctx, request.AVR, request.Name, request.Zone)
+	if err != nil {
+		return nil, err
+	}
+	return &favourite, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// polling backs off exponentially while an AVR is unreachable, up to maxPollBackoff between attempts
+const (
+	maxPollBackoff       = 5 * time.Minute
+	offlineAfterFailures = 2 // consecutive failed polls before an AVR is marked offline
+)
+
+// connectionHealth tracks consecutive poll failures for an AVR so the poller can back off
+// and report when it goes offline/online
+type connectionHealth struct {
+	sync.Mutex
+	failures     int
+	offline      bool
+	offlineSince time.Time
+	lastError    error
+	polls        uint64 // every poll recorded, for the metrics
+	pollFailures uint64
+	lastSuccess  time.Time // when the AVR last answered a poll
+	lastFailure  error     // the most recent poll error, kept after polls succeed again
+	lastFailed   time.Time
+}
+
+// record updates the health with the result of a poll and returns true if the AVR
+// has just gone offline or come back online
+func (h *connectionHealth) record(err error) (changed bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.lastError = err
+	h.polls++
+	if err == nil {
+		h.lastSuccess = time.Now()
+		h.failures = 0
+		changed = h.offline
+		h.offline = false
+		return changed
+	}
+
+	h.failures++
+	h.pollFailures++
+	h.lastFailure, h.lastFailed = err, time.Now()
+	if !h.offline && h.failures >= offlineAfterFailures {
+		h.offline = true
+		h.offlineSince = time.Now()
+		return true
+	}
+	return false
+}
+
+// Offline returns whether the AVR is currently unreachable, and since when
+func (h *connectionHealth) Offline() (bool, time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	return h.offline, h.offlineSince
+}
+
+// LastError returns the error from the most recent poll (nil if it succeeded)
+func (h *connectionHealth) LastError() error {
+	h.Lock()
+	defer h.Unlock()
+	return h.lastError
+}
+
+// LastSuccess returns when the AVR last answered a poll (zero if it hasn't)
+func (h *connectionHealth) LastSuccess() time.Time {
+	h.Lock()
+	defer h.Unlock()
+	return h.lastSuccess
+}
+
+// LastFailure returns when the most recent poll error happened and the error, even if polls have succeeded since
+func (h *connectionHealth) LastFailure() (time.Time, error) {
+	h.Lock()
+	defer h.Unlock()
+	return h.lastFailed, h.lastFailure
+}
+
+// Polls returns how many polls were recorded and how many of them failed
+func (h *connectionHealth) Polls() (polls, failures uint64) {
+	h.Lock()
+	defer h.Unlock()
+	return h.polls, h.pollFailures
+}
+
+// nextPoll returns how long to wait before polling again: the normal interval while healthy,
+// doubling with each consecutive failure up to maxPollBackoff
+func (h *connectionHealth) nextPoll(interval time.Duration) time.Duration {
+	h.Lock()
+	defer h.Unlock()
+
+	delay := interval
+	for i := 0; i < h.failures && delay < maxPollBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxPollBackoff {
+		delay = maxPollBackoff
+	}
+	return delay
+}
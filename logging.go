@@ -0,0 +1,152 @@
+package main
+
+// logging: every line goes through redact so tokens and passwords never reach the log, and lines about one
+// AVR are tagged with key=value fields (avr, name, zone, op) so one AVR's history can be grepped out, e.g.
+//
+//	AVR disagrees with command avr=Y1234 name="Living Room" ip=192.168.1.20 zone=2 op=setPower want=true got=false
+//
+// each AVR has its own log level (set on its edit form), so one AVR can be debugged without the rest
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ninjasphere/go-ninja/logger"
+)
+
+// driverLogger is the driver's logger, redacting secrets from every line
+type driverLogger struct {
+	*logger.Logger
+}
+
+func (l driverLogger) Debugf(format string, a ...interface{}) {
+	l.Logger.Debugf("%s", redact(fmt.Sprintf(format, a...)))
+}
+
+func (l driverLogger) Infof(format string, a ...interface{}) {
+	l.Logger.Infof("%s", redact(fmt.Sprintf(format, a...)))
+}
+
+func (l driverLogger) Warningf(format string, a ...interface{}) {
+	l.Logger.Warningf("%s", redact(fmt.Sprintf(format, a...)))
+}
+
+func (l driverLogger) Errorf(format string, a ...interface{}) {
+	l.Logger.Errorf("%s", redact(fmt.Sprintf(format, a...)))
+}
+
+func (l driverLogger) Fatalf(format string, a ...interface{}) {
+	l.Logger.Fatalf("%s", redact(fmt.Sprintf(format, a...)))
+}
+
+// secrets match the values of tokens and passwords in JSON (config, form data), key=value fields,
+// Go's %+v and Authorization headers
+var secrets = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)("[a-z]*(?:token|password)"\s*:\s*")(?:[^"\\]|\\.)*(")`),
+	regexp.MustCompile(`(?i)(\b[a-z]*(?:token|password)[=:])(?:"(?:[^"\\]|\\.)*"|[^\s,}\]]+)()`),
+	regexp.MustCompile(`(?i)(\bbearer\s+)[^\s"]+()`),
+	// JSON inside a JSON string, e.g. config pasted into the import form
+	regexp.MustCompile(`(?i)(\\"[a-z]*(?:token|password)\\"\s*:\s*\\")(?:[^"\\]|\\[^"])*(\\")`),
+}
+
+// redact replaces any secrets in a log line with <redacted>
+func redact(line string) string {
+	for _, secret := range secrets {
+		line = secret.ReplaceAllString(line, "${1}<redacted>${2}")
+	}
+	return line
+}
+
+// log levels for AVRs, from the edit form's logLevel
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+var logLevels = []string{"debug", "info", "warning", "error"}
+
+const defaultLogLevel = "info"
+
+// parseLogLevel returns the level for a name in logLevels ("" is defaultLogLevel)
+func parseLogLevel(name string) (int, bool) {
+	if name == "" {
+		name = defaultLogLevel
+	}
+	for level, n := range logLevels {
+		if n == name {
+			return level, true
+		}
+	}
+	return levelInfo, false
+}
+
+// an avrLogger logs lines about one AVR, with its fields after the message
+// it's a value, so zone, op and with return a copy with another field
+type avrLogger struct {
+	level  int
+	fields string
+}
+
+// logFor returns a logger for lines about an AVR
+func logFor(config *AVRConfig) avrLogger {
+	level, _ := parseLogLevel(config.LogLevel)
+	l := avrLogger{level: level}
+	if config.ID != "" {
+		l = l.with("avr", config.ID)
+	}
+	return l.with("name", config.Name).with("ip", config.IP)
+}
+
+// logOp returns a logger for lines that aren't about one AVR (e.g. loading the config), tagged with op
+func logOp(op string) avrLogger {
+	return avrLogger{level: levelInfo}.op(op)
+}
+
+// zone adds the zone the line is about
+func (l avrLogger) zone(zone int) avrLogger {
+	return l.with("zone", zone)
+}
+
+// op adds the operation (e.g. poll, setVolume, connect) the line is about
+func (l avrLogger) op(op string) avrLogger {
+	return l.with("op", op)
+}
+
+// with adds a field, quoting values with spaces, quotes or = in them
+func (l avrLogger) with(key string, value interface{}) avrLogger {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		s = strconv.Quote(s)
+	}
+	l.fields += " " + key + "=" + s
+	return l
+}
+
+// Debugf lines are only logged when this AVR is set to debug, and then only if the driver's own logger
+// lets debug lines through
+func (l avrLogger) Debugf(format string, a ...interface{}) {
+	if l.level <= levelDebug {
+		log.Debugf("%s", fmt.Sprintf(format, a...)+l.fields)
+	}
+}
+
+func (l avrLogger) Infof(format string, a ...interface{}) {
+	if l.level <= levelInfo {
+		log.Infof("%s", fmt.Sprintf(format, a...)+l.fields)
+	}
+}
+
+func (l avrLogger) Warningf(format string, a ...interface{}) {
+	if l.level <= levelWarning {
+		log.Warningf("%s", fmt.Sprintf(format, a...)+l.fields)
+	}
+}
+
+// Errorf lines are always logged
+func (l avrLogger) Errorf(format string, a ...interface{}) {
+	log.Errorf("%s", fmt.Sprintf(format, a...)+l.fields)
+}
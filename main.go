@@ -8,7 +8,7 @@ import (
 
 func main() {
 
-	_, err := NewDriver()
+	driver, err := NewDriver()
 
 	if err != nil {
 		log.Infof("Failed to create driver: %s", err)
@@ -21,5 +21,6 @@ func main() {
 	// Block until a signal is received.
 	s := <-c
 	fmt.Println("Got signal:", s)
+	driver.Stop()
 
 }
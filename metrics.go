@@ -0,0 +1,195 @@
+package main
+
+// an optional Prometheus /metrics endpoint, showing how each AVR's requests and polls are going
+// (in the Prometheus text format, written here rather than pulling in the Prometheus client library)
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+)
+
+// MetricsConfig turns on the /metrics endpoint, it's off if Port is 0
+type MetricsConfig struct {
+	Port int `json:"port,string,omitempty"`
+}
+
+// startMetrics serves /metrics if it's configured, stopping it first if it's already running
+// the caller holds configLock
+func (d *Driver) startMetrics() error {
+	if d.metrics != nil {
+		d.metrics.Close()
+		d.stopMetrics()
+		d.metrics, d.stopMetrics = nil, nil
+	}
+	port := d.config.Metrics.Port
+	if port == 0 {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("Could not serve metrics on port %d: %s", port, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", d.serveMetrics)
+	server := &http.Server{Handler: mux, ReadTimeout: requestTimeout, WriteTimeout: requestTimeout}
+	ctx, stop := context.WithCancel(d.ctx)
+	d.metrics, d.stopMetrics = server, stop
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Metrics stopped: %s", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Infof("Serving metrics on port %d", port)
+	return nil
+}
+
+// avrMetrics is a snapshot of one AVR's counters, taken while holding configLock
+type avrMetrics struct {
+	labels   string // avr="<id>",name="<name>"
+	requests map[ync.Priority]ync.RequestStats
+	queue    ync.QueueStats
+	polls    uint64
+	failures uint64
+	online   bool
+	zones    map[int]ync.ZoneStatus
+}
+
+func (d *Driver) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var avrs []avrMetrics
+	d.configLock.Lock()
+	for id, config := range d.config.AVRs {
+		device, ok := d.devices[id]
+		if !ok {
+			continue
+		}
+		offline, _ := device.health.Offline()
+		m := avrMetrics{
+			labels:   fmt.Sprintf(`avr="%s",name="%s"`, labelValue(id), labelValue(config.Name)),
+			requests: device.client.RequestStats(),
+			queue:    device.client.QueueStats(),
+			online:   !offline,
+			zones:    make(map[int]ync.ZoneStatus),
+		}
+		m.polls, m.failures = device.health.Polls()
+		for zone := 1; zone <= zoneCount(config); zone++ {
+			if status, ok := device.status.Zone(zone); ok {
+				m.zones[zone] = status
+			}
+		}
+		avrs = append(avrs, m)
+	}
+	d.configLock.Unlock()
+	sort.Slice(avrs, func(i, j int) bool { return avrs[i].labels < avrs[j].labels })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, avrs)
+}
+
+// labelValue escapes a label value for the Prometheus text format
+func labelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// writeMetrics writes every metric family, one AVR (and priority or zone) per sample
+func writeMetrics(w io.Writer, avrs []avrMetrics) {
+	family := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	sample := func(name, labels string, value float64) {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	priorities := []ync.Priority{ync.UserPriority, ync.PollPriority}
+	byPriority := func(name, kind, help string, value func(ync.RequestStats) float64) {
+		family(name, kind, help)
+		for _, avr := range avrs {
+			for _, p := range priorities {
+				sample(name, fmt.Sprintf(`%s,priority="%s"`, avr.labels, p), value(avr.requests[p]))
+			}
+		}
+	}
+	perAVR := func(name, kind, help string, value func(avrMetrics) float64) {
+		family(name, kind, help)
+		for _, avr := range avrs {
+			sample(name, avr.labels, value(avr))
+		}
+	}
+	perZone := func(name, help string, value func(ync.ZoneStatus) float64) {
+		family(name, "gauge", help)
+		for _, avr := range avrs {
+			for zone := 1; zone <= ync.MaxZones; zone++ {
+				if status, ok := avr.zones[zone]; ok {
+					sample(name, fmt.Sprintf(`%s,zone="%d"`, avr.labels, zone), value(status))
+				}
+			}
+		}
+	}
+
+	byPriority("avr_commands_total", "counter", "YNC requests sent to the AVR (user commands or polling).",
+		func(s ync.RequestStats) float64 { return float64(s.Sent) })
+	byPriority("avr_command_failures_total", "counter", "YNC requests that failed or timed out.",
+		func(s ync.RequestStats) float64 { return float64(s.Failed) })
+
+	name := "avr_request_duration_seconds"
+	family(name, "histogram", "How long YNC requests to the AVR took.")
+	for _, avr := range avrs {
+		for _, p := range priorities {
+			stats := avr.requests[p]
+			labels := fmt.Sprintf(`%s,priority="%s"`, avr.labels, p)
+			var count uint64
+			for i, bound := range ync.LatencyBuckets {
+				count += stats.Latency[i]
+				sample(name+"_bucket", fmt.Sprintf(`%s,le="%s"`, labels, strconv.FormatFloat(bound, 'g', -1, 64)), float64(count))
+			}
+			sample(name+"_bucket", labels+`,le="+Inf"`, float64(stats.Sent))
+			sample(name+"_sum", labels, stats.Seconds)
+			sample(name+"_count", labels, float64(stats.Sent))
+		}
+	}
+
+	perAVR("avr_polls_total", "counter", "Polls of every zone's status.",
+		func(avr avrMetrics) float64 { return float64(avr.polls) })
+	perAVR("avr_poll_failures_total", "counter", "Polls that failed.",
+		func(avr avrMetrics) float64 { return float64(avr.failures) })
+	perAVR("avr_poll_success_ratio", "gauge", "Share of polls that succeeded (1 before the first poll).",
+		func(avr avrMetrics) float64 {
+			if avr.polls == 0 {
+				return 1
+			}
+			return float64(avr.polls-avr.failures) / float64(avr.polls)
+		})
+	perAVR("avr_online", "gauge", "1 if the AVR is answering polls.",
+		func(avr avrMetrics) float64 { return boolValue(avr.online) })
+	perAVR("avr_queue_depth", "gauge", "Requests waiting to be sent to the AVR.",
+		func(avr avrMetrics) float64 { return float64(avr.queue.Depth) })
+	perAVR("avr_queue_coalesced_total", "counter", "Requests replaced by a later one before they were sent.",
+		func(avr avrMetrics) float64 { return float64(avr.queue.Coalesced) })
+
+	perZone("avr_power", "1 if the zone is on.", func(s ync.ZoneStatus) float64 { return boolValue(s.Power) })
+	perZone("avr_volume_db", "The zone's volume in dB.", func(s ync.ZoneStatus) float64 { return s.Volume })
+	perZone("avr_muted", "1 if the zone is muted.", func(s ync.ZoneStatus) float64 { return boolValue(s.Muted) })
+
+	family("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
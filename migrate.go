@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// the config Ninja saves for us is upgraded when it's loaded, one version at a time, so changes to
+// Config and AVRConfig don't break existing users' config
+// to change the format: add a migration to the end of migrations (configVersion goes up by itself)
+
+// migrations[n] upgrades a version n config to version n+1, working on the decoded JSON
+// (numbers are strings, because of the ",string" tags)
+var migrations = []func(raw map[string]interface{}) error{
+	migrateUnversioned,
+	migrateRedetect,
+}
+
+// configVersion is the version of config this driver writes
+var configVersion = len(migrations)
+
+// UnmarshalJSON migrates old config to the current version before decoding it
+// if it can't be migrated, it's decoded as well as it can be and the original is kept in Unmigrated
+// (which is saved with the config) so it's never lost - an error here would stop the driver starting
+func (c *Config) UnmarshalJSON(data []byte) error {
+	// plain has the same fields but not this method, so decoding it doesn't come back here
+	type plain Config
+
+	migrated, version, err := migrateConfig(data)
+	if err == nil {
+		return json.Unmarshal(migrated, (*plain)(c))
+	}
+
+	logOp("migrateConfig").with("from", version).with("to", configVersion).with("error", err).Errorf("Could not migrate config, keeping the original")
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		logOp("migrateConfig").with("error", err).Errorf("Could not read config, starting without it")
+		*c = Config{}
+	}
+	c.Version = version
+	if c.Unmigrated == nil {
+		c.Unmigrated = append(json.RawMessage{}, data...)
+	}
+	return nil
+}
+
+// migrateConfig runs each migration needed to bring data up to configVersion,
+// returning the migrated JSON and the version data was
+func migrateConfig(data []byte) ([]byte, int, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, err
+	}
+	if raw == nil {
+		// "null" - no config yet
+		raw = make(map[string]interface{})
+	}
+
+	version := 0
+	if v, ok := raw["version"]; ok {
+		s, _ := v.(string)
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, 0, fmt.Errorf("Invalid config version %v", v)
+		}
+		version = n
+	}
+	if version > configVersion {
+		// saved by a newer driver, nothing we can do but hope it still works
+		logOp("migrateConfig").with("version", version).with("driverVersion", configVersion).Warningf("Config is newer than this driver")
+		return data, version, nil
+	}
+
+	for v := version; v < configVersion; v++ {
+		if err := migrations[v](raw); err != nil {
+			return nil, version, fmt.Errorf("Version %d to %d: %s", v, v+1, err)
+		}
+		logOp("migrateConfig").with("from", v).with("to", v+1).Infof("Migrated config")
+	}
+	raw["version"] = strconv.Itoa(configVersion)
+
+	migrated, err := json.Marshal(raw)
+	return migrated, version, err
+}
+
+// eachAVR calls f with the decoded config of every AVR (saved and pending) in a raw config
+func eachAVR(raw map[string]interface{}, f func(avr map[string]interface{}) error) error {
+	for _, key := range []string{"AVRs", "Pending"} {
+		if raw[key] == nil {
+			continue
+		}
+		avrs, ok := raw[key].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not a map", key)
+		}
+		for id, value := range avrs {
+			avr, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("AVR %s is not an object", id)
+			}
+			if err := f(avr); err != nil {
+				return fmt.Errorf("AVR %s: %s", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// migrateUnversioned upgrades config from before versioning: zones used to always be entered by hand,
+// so they become an override of the detected number of zones to keep them the same
+func migrateUnversioned(raw map[string]interface{}) error {
+	return eachAVR(raw, func(avr map[string]interface{}) error {
+		zones, ok := avr["zones"]
+		if !ok {
+			return nil
+		}
+		if _, ok := zones.(string); !ok {
+			return fmt.Errorf("zones is not a string: %v", zones)
+		}
+		if _, ok := avr["zonesOverride"]; !ok {
+			avr["zonesOverride"] = zones
+		}
+		return nil
+	})
+}
+
+// migrateRedetect marks capabilities detected before DSP programs and tuner bands were as undetected,
+// so the poller detects them again (until then everything is shown, as for any undetected AVR)
+func migrateRedetect(raw map[string]interface{}) error {
+	return eachAVR(raw, func(avr map[string]interface{}) error {
+		if avr["capabilities"] == nil {
+			return nil
+		}
+		capabilities, ok := avr["capabilities"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("capabilities is not an object: %v", avr["capabilities"])
+		}
+		delete(capabilities, "detected")
+		return nil
+	})
+}
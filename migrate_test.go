@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestMigrateUnversioned(t *testing.T) {
+	var raw map[string]interface{}
+	data := `{"AVRs": {"A1": {"zones": "2"}, "B2": {"zones": "3", "zonesOverride": "1"}, "C3": {}},
+		"Pending": {"192.168.1.20": {"zones": "2"}}}`
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUnversioned(raw); err != nil {
+		t.Fatal(err)
+	}
+	avr := func(key, id string) map[string]interface{} {
+		return raw[key].(map[string]interface{})[id].(map[string]interface{})
+	}
+	if got := avr("AVRs", "A1")["zonesOverride"]; got != "2" {
+		t.Errorf("A1 zonesOverride = %v, want its zones (2)", got)
+	}
+	if got := avr("AVRs", "B2")["zonesOverride"]; got != "1" {
+		t.Errorf("B2 zonesOverride = %v, want the existing override (1)", got)
+	}
+	if _, ok := avr("AVRs", "C3")["zonesOverride"]; ok {
+		t.Error("C3 has a zonesOverride without any zones")
+	}
+	if got := avr("Pending", "192.168.1.20")["zonesOverride"]; got != "2" {
+		t.Errorf("pending zonesOverride = %v, want its zones (2)", got)
+	}
+
+	raw = map[string]interface{}{"AVRs": map[string]interface{}{"A1": map[string]interface{}{"zones": 2.0}}}
+	if err := migrateUnversioned(raw); err == nil {
+		t.Error("migrateUnversioned worked with zones that aren't a string")
+	}
+}
+
+func TestMigrateRedetect(t *testing.T) {
+	var raw map[string]interface{}
+	data := `{"AVRs": {"A1": {"capabilities": {"detected": "true", "features": ["Tuner"], "firmware": "1.80"}}, "B2": {}},
+		"Pending": {"192.168.1.20": {"capabilities": {"detected": "true"}}}}`
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateRedetect(raw); err != nil {
+		t.Fatal(err)
+	}
+	capabilities := func(key, id string) map[string]interface{} {
+		return raw[key].(map[string]interface{})[id].(map[string]interface{})["capabilities"].(map[string]interface{})
+	}
+	if a1 := capabilities("AVRs", "A1"); a1["detected"] != nil || a1["firmware"] != "1.80" || a1["features"] == nil {
+		t.Errorf("A1 capabilities = %v, want only detected removed", a1)
+	}
+	if pending := capabilities("Pending", "192.168.1.20"); pending["detected"] != nil {
+		t.Errorf("pending capabilities = %v, want detected removed", pending)
+	}
+
+	raw = map[string]interface{}{"AVRs": map[string]interface{}{"A1": map[string]interface{}{"capabilities": "yes"}}}
+	if err := migrateRedetect(raw); err == nil {
+		t.Error("migrateRedetect worked with capabilities that aren't an object")
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	// no config yet
+	migrated, version, err := migrateConfig([]byte("null"))
+	if err != nil || version != 0 {
+		t.Fatalf("migrateConfig(null) = %d, %v", version, err)
+	}
+	if want := fmt.Sprintf(`{"version":"%d"}`, configVersion); string(migrated) != want {
+		t.Errorf("migrateConfig(null) = %s, want %s", migrated, want)
+	}
+
+	// a newer driver's config is left as it is
+	newer := []byte(fmt.Sprintf(`{"version":"%d","AVRs":{},"somethingNew":true}`, configVersion+1))
+	migrated, version, err = migrateConfig(newer)
+	if err != nil || version != configVersion+1 || string(migrated) != string(newer) {
+		t.Errorf("migrateConfig(newer) = %s, %d, %v, want it unchanged", migrated, version, err)
+	}
+
+	for _, invalid := range []string{`{"version":"one"}`, `{"version":"-1"}`, `{"version":1}`} {
+		if _, _, err := migrateConfig([]byte(invalid)); err == nil {
+			t.Errorf("migrateConfig(%s) worked with an invalid version", invalid)
+		}
+	}
+}
+
+func TestConfigUnmarshalMigrates(t *testing.T) {
+	var config Config
+	if err := json.Unmarshal([]byte(`{"AVRs": {"A1": {"ID": "A1", "zones": "2"}}}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Version != configVersion || config.Unmigrated != nil {
+		t.Errorf("config is version %d (unmigrated %s), want %d", config.Version, config.Unmigrated, configVersion)
+	}
+	if avr := config.AVRs["A1"]; avr == nil || avr.Zones != 2 || avr.ZonesOverride != 2 {
+		t.Errorf("AVR A1 = %+v, want 2 zones overridden", avr)
+	}
+}
+
+func TestConfigUnmarshalKeepsUnmigrated(t *testing.T) {
+	// a migration to the next version that always fails
+	defer func(saved []func(map[string]interface{}) error, version int) {
+		migrations, configVersion = saved, version
+	}(migrations, configVersion)
+	migrations = append(migrations[:len(migrations):len(migrations)], func(raw map[string]interface{}) error {
+		return fmt.Errorf("broken")
+	})
+	configVersion = len(migrations)
+
+	data := fmt.Sprintf(`{"version":"%d","AVRs":{"A1":{"ID":"A1","Name":"Lounge","zones":"2"}}}`, configVersion-1)
+	var config Config
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatalf("a config that can't be migrated failed to load: %s", err)
+	}
+	if config.Version != configVersion-1 {
+		t.Errorf("Version = %d, want the original %d", config.Version, configVersion-1)
+	}
+	if string(config.Unmigrated) != data {
+		t.Errorf("Unmigrated = %s, want the original config", config.Unmigrated)
+	}
+	if avr := config.AVRs["A1"]; avr == nil || avr.Name != "Lounge" {
+		t.Errorf("AVR A1 = %+v, want it decoded as well as it can be", avr)
+	}
+
+	// a config that's already unmigrated keeps the first original
+	saved, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reloaded Config
+	if err := json.Unmarshal(saved, &reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if string(reloaded.Unmigrated) != data || reloaded.Version != configVersion-1 {
+		t.Errorf("reloaded config is version %d with unmigrated %s, want the original", reloaded.Version, reloaded.Unmigrated)
+	}
+}
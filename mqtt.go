@@ -0,0 +1,495 @@
+package main
+
+// an optional bridge to an external MQTT broker, so Home Assistant (or anything else that speaks MQTT) can
+// see and control each AVR zone, using the same Device methods as the Ninja channels
+//
+//	<prefix>/availability                   "online" or "offline" (the bridge, retained, offline is the will)
+//	<prefix>/<id>/availability              "online" or "offline" (whether the AVR answers polls)
+//	<prefix>/<id>/<zone>/state              the zone's status as JSON, like the HTTP API's zones (retained)
+//	<prefix>/<id>/<zone>/power/set          ON or OFF
+//	<prefix>/<id>/<zone>/volume/set         dB, e.g. -35.5
+//	<prefix>/<id>/<zone>/muted/set          ON or OFF
+//	<prefix>/<id>/<zone>/input/set          an input name, e.g. NET RADIO
+//	<prefix>/<id>/1/sound_program/set       a DSP program, e.g. 7ch Stereo (only if the AVR has them)
+//
+// each zone is a Home Assistant device found through discovery (<discovery prefix>/<component>/<object id>/config)
+// NOTE: Home Assistant's MQTT integration has no media_player platform, so a zone is a power switch, volume
+// number, mute switch, input select (and sound program text) grouped into one device rather than a single
+// media_player entity
+// NOTE: the broker is only reached through its URL, so the bridge works the same against an in-process broker
+// listening on localhost
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+	"github.com/lindsaymarkward/go-avr-yamaha"
+)
+
+const (
+	defaultMQTTPrefix          = "yamaha-avr"
+	defaultMQTTDiscoveryPrefix = "homeassistant"
+)
+
+// MQTTConfig turns on the MQTT bridge, it's off if Broker is blank
+type MQTTConfig struct {
+	Broker          string `json:"broker,omitempty"` // e.g. tcp://192.168.1.10:1883
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	Prefix          string `json:"prefix,omitempty"`          // for state and command topics, defaultMQTTPrefix if blank
+	DiscoveryPrefix string `json:"discoveryPrefix,omitempty"` // Home Assistant's, defaultMQTTDiscoveryPrefix if blank
+}
+
+func (c MQTTConfig) prefix() string {
+	if c.Prefix == "" {
+		return defaultMQTTPrefix
+	}
+	return c.Prefix
+}
+
+func (c MQTTConfig) discoveryPrefix() string {
+	if c.DiscoveryPrefix == "" {
+		return defaultMQTTDiscoveryPrefix
+	}
+	return c.DiscoveryPrefix
+}
+
+// validBrokerURL returns whether broker is a URL the MQTT client can connect to
+func validBrokerURL(broker string) bool {
+	u, err := url.Parse(broker)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "tcp", "ssl", "tls", "ws", "wss", "mqtt", "mqtts":
+		return true
+	}
+	return false
+}
+
+// mqttBridge publishes AVR zones to the broker and applies the commands it receives
+// it lives as long as the driver, start connects it (again) whenever the settings change
+type mqttBridge struct {
+	driver *Driver
+	lock   sync.Mutex // guards everything below, as states are published from every AVR's poller
+	config MQTTConfig
+	client mqtt.Client                // nil unless the bridge is turned on
+	states map[string][]byte          // the last state published for each "<id>/<zone>"
+	online map[string]bool            // the last availability published for each AVR
+	shown  map[string]mqttDescription // what the discovery config published for each AVR described
+}
+
+// an mqttDescription is the part of an AVR's config its discovery config depends on,
+// so discovery is only published again when it changes
+type mqttDescription struct {
+	Name          string
+	Model         string
+	Zones         int
+	MaxVolume     float64
+	Inputs        string
+	SoundPrograms bool
+}
+
+func describeForMQTT(config *AVRConfig) mqttDescription {
+	return mqttDescription{
+		Name:      config.Name,
+		Model:     config.Model,
+		Zones:     zoneCount(config),
+		MaxVolume: config.MaxVolume,
+		Inputs:    strings.Join(config.Capabilities.inputs(), "\n"),
+
+		SoundPrograms: config.Capabilities.hasSoundPrograms(1),
+	}
+}
+
+// zoneCount returns how many zones are read from the AVR, at least the main zone
+func zoneCount(config *AVRConfig) int {
+	if config.Zones < 1 {
+		return 1
+	}
+	return config.Zones
+}
+
+func newMQTTBridge(driver *Driver) *mqttBridge {
+	return &mqttBridge{driver: driver}
+}
+
+// startMQTT connects the MQTT bridge if it's configured, disconnecting it first if it's running
+// the caller holds configLock
+func (d *Driver) startMQTT() error {
+	return d.mqtt.start(d.config.MQTT)
+}
+
+// start disconnects from any broker, then connects to config's broker (if there is one)
+// the client keeps trying in the background, so a broker that's down doesn't stop the driver starting
+func (b *mqttBridge) start(config MQTTConfig) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.client != nil {
+		b.publish(b.config.prefix()+"/availability", "offline")
+		b.client.Disconnect(250)
+		b.client = nil
+	}
+	b.config = config
+	b.reset()
+	if config.Broker == "" {
+		return nil
+	}
+	if !validBrokerURL(config.Broker) {
+		return fmt.Errorf("Could not start the MQTT bridge: invalid broker %q", config.Broker)
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(info.ID+"-"+config.prefix()).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(config.prefix()+"/availability", "offline", 1, true).
+		SetOnConnectHandler(b.connected).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warningf("Lost connection to MQTT broker %s, reconnecting: %s", config.Broker, err)
+		})
+	b.client = mqtt.NewClient(options)
+	b.client.Connect()
+
+	go func(client mqtt.Client) {
+		<-b.driver.ctx.Done()
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.client == client {
+			b.publish(config.prefix()+"/availability", "offline")
+			client.Disconnect(250)
+			b.client = nil
+		}
+	}(b.client)
+	log.Infof("MQTT bridge connecting to %s", config.Broker)
+	return nil
+}
+
+// reset forgets everything that was published, so it's all published again
+// the caller holds b.lock
+func (b *mqttBridge) reset() {
+	b.states = make(map[string][]byte)
+	b.online = make(map[string]bool)
+	b.shown = make(map[string]mqttDescription)
+}
+
+// connected runs each time the client (re)connects, the broker may have lost retained messages
+// so discovery and states are published again by the pollers
+func (b *mqttBridge) connected(client mqtt.Client) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if client != b.client {
+		return
+	}
+	log.Infof("MQTT bridge connected to %s", b.config.Broker)
+	b.reset()
+	b.publish(b.config.prefix()+"/availability", "online")
+	prefix := b.config.prefix()
+	client.Subscribe(prefix+"/+/+/+/set", 1, func(_ mqtt.Client, message mqtt.Message) {
+		// the client delivers messages one at a time and waits for them while disconnecting, and commands
+		// wait for configLock (held while settings are saved) and the AVR, so they run on their own
+		go b.command(prefix, message.Topic(), strings.TrimSpace(string(message.Payload())))
+	})
+}
+
+// publish sends a retained message, without waiting for the broker to acknowledge it
+// the caller holds b.lock
+func (b *mqttBridge) publish(topic string, payload interface{}) {
+	b.client.Publish(topic, 1, true, payload)
+}
+
+// isConnected returns whether messages can be published
+// the caller holds b.lock
+func (b *mqttBridge) isConnected() bool {
+	return b.client != nil && b.client.IsConnected()
+}
+
+// publishStates publishes the zones that changed since they were last published, and the AVR's
+// discovery config if it changed (or hasn't been published since connecting)
+func (b *mqttBridge) publishStates(config *AVRConfig, zones map[int]ync.ZoneStatus) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.isConnected() {
+		return
+	}
+	b.discover(config)
+	b.setOnline(config, true)
+
+	for zone, status := range zones {
+		state, err := json.Marshal(makeAPIZone(config, status))
+		if err != nil {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", config.ID, zone)
+		if string(b.states[key]) == string(state) {
+			continue
+		}
+		b.states[key] = state
+		b.publish(b.topic(config.ID, zone, "state"), state)
+	}
+}
+
+// publishAvailability publishes whether the AVR is answering polls
+func (b *mqttBridge) publishAvailability(config *AVRConfig, online bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.isConnected() {
+		b.setOnline(config, online)
+	}
+}
+
+// the caller holds b.lock
+func (b *mqttBridge) setOnline(config *AVRConfig, online bool) {
+	if was, ok := b.online[config.ID]; ok && was == online {
+		return
+	}
+	b.online[config.ID] = online
+	payload := "offline"
+	if online {
+		payload = "online"
+	}
+	b.publish(b.config.prefix()+"/"+config.ID+"/availability", payload)
+}
+
+// topic is a zone's topic, e.g. yamaha-avr/<id>/2/state
+func (b *mqttBridge) topic(id string, zone int, name string) string {
+	return fmt.Sprintf("%s/%s/%d/%s", b.config.prefix(), id, zone, name)
+}
+
+// an mqttEntity is the Home Assistant discovery config for one of a zone's controls
+type mqttEntity struct {
+	Name              string      `json:"name"`
+	UniqueID          string      `json:"unique_id"`
+	StateTopic        string      `json:"state_topic"`
+	ValueTemplate     string      `json:"value_template"`
+	CommandTopic      string      `json:"command_topic"`
+	Availability      []mqttTopic `json:"availability"`
+	AvailabilityMode  string      `json:"availability_mode"`
+	PayloadOn         string      `json:"payload_on,omitempty"`
+	PayloadOff        string      `json:"payload_off,omitempty"`
+	Min               *float64    `json:"min,omitempty"`
+	Max               *float64    `json:"max,omitempty"`
+	Step              float64     `json:"step,omitempty"`
+	UnitOfMeasurement string      `json:"unit_of_measurement,omitempty"`
+	Options           []string    `json:"options,omitempty"`
+	Icon              string      `json:"icon,omitempty"`
+	Device            mqttDevice  `json:"device"`
+	component         string      // switch, number, select or text
+}
+
+type mqttTopic struct {
+	Topic string `json:"topic"`
+}
+
+type mqttDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+	ViaDevice    string   `json:"via_device,omitempty"`
+}
+
+// discover publishes the discovery config for every zone of the AVR if it changed since it was last published,
+// removing zones and controls the AVR no longer has
+// the caller holds b.lock
+func (b *mqttBridge) discover(config *AVRConfig) {
+	description := describeForMQTT(config)
+	previous, shown := b.shown[config.ID]
+	if shown && previous == description {
+		return
+	}
+	for zone := 1; zone <= description.Zones; zone++ {
+		has := make(map[string]bool)
+		for _, entity := range b.entities(config, zone, false) {
+			payload, err := json.Marshal(entity)
+			if err != nil {
+				continue
+			}
+			b.publish(b.discoveryTopic(entity), payload)
+			has[entity.UniqueID] = true
+		}
+		// e.g. the sound program of an AVR that turned out not to have DSP programs once it was detected
+		for _, entity := range b.entities(config, zone, true) {
+			if !has[entity.UniqueID] {
+				b.publish(b.discoveryTopic(entity), "")
+			}
+		}
+	}
+	for zone := description.Zones + 1; shown && zone <= previous.Zones; zone++ {
+		b.removeZone(config, zone)
+	}
+	b.shown[config.ID] = description
+}
+
+// remove removes the AVR's entities from Home Assistant (and its retained messages), e.g. when it's deleted
+func (b *mqttBridge) remove(config *AVRConfig) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.isConnected() {
+		return
+	}
+	zones := zoneCount(config)
+	if previous, ok := b.shown[config.ID]; ok && previous.Zones > zones {
+		zones = previous.Zones
+	}
+	for zone := 1; zone <= zones; zone++ {
+		b.removeZone(config, zone)
+	}
+	b.publish(b.config.prefix()+"/"+config.ID+"/availability", "")
+	delete(b.shown, config.ID)
+	delete(b.online, config.ID)
+}
+
+// removeZone publishes empty discovery configs and state for a zone, which deletes them
+// the caller holds b.lock
+func (b *mqttBridge) removeZone(config *AVRConfig, zone int) {
+	for _, entity := range b.entities(config, zone, true) {
+		b.publish(b.discoveryTopic(entity), "")
+	}
+	b.publish(b.topic(config.ID, zone, "state"), "")
+	delete(b.states, fmt.Sprintf("%s/%d", config.ID, zone))
+}
+
+func (b *mqttBridge) discoveryTopic(entity mqttEntity) string {
+	return fmt.Sprintf("%s/%s/%s/config", b.config.discoveryPrefix(), entity.component, entity.UniqueID)
+}
+
+// entities returns the discovery configs for a zone's controls, all includes the ones the zone doesn't have
+// (so they can be removed)
+func (b *mqttBridge) entities(config *AVRConfig, zone int, all bool) []mqttEntity {
+	device := mqttDevice{
+		Identifiers:  []string{fmt.Sprintf("yamaha_avr_%s_zone_%d", config.ID, zone)},
+		Name:         config.Name,
+		Manufacturer: "Yamaha",
+		Model:        config.Model,
+	}
+	if zone > 1 {
+		device.Name = fmt.Sprintf("%s Zone %d", config.Name, zone)
+		device.ViaDevice = fmt.Sprintf("yamaha_avr_%s_zone_1", config.ID)
+	}
+	entity := func(component, name, label, template, icon string) mqttEntity {
+		return mqttEntity{
+			Name:          label,
+			UniqueID:      fmt.Sprintf("yamaha_avr_%s_zone_%d_%s", config.ID, zone, name),
+			StateTopic:    b.topic(config.ID, zone, "state"),
+			ValueTemplate: template,
+			CommandTopic:  b.topic(config.ID, zone, name+"/set"),
+			Availability: []mqttTopic{
+				{Topic: b.config.prefix() + "/availability"},
+				{Topic: b.config.prefix() + "/" + config.ID + "/availability"},
+			},
+			AvailabilityMode: "all",
+			Icon:             icon,
+			Device:           device,
+			component:        component,
+		}
+	}
+
+	power := entity("switch", "power", "Power", "{{ 'ON' if value_json.power else 'OFF' }}", "mdi:power")
+	power.PayloadOn, power.PayloadOff = "ON", "OFF"
+
+	min, max := avryamaha.MinVolume, config.MaxVolume
+	volume := entity("number", "volume", "Volume", "{{ value_json.volume }}", "mdi:volume-high")
+	volume.Min, volume.Max, volume.Step, volume.UnitOfMeasurement = &min, &max, 0.5, "dB"
+
+	muted := entity("switch", "muted", "Mute", "{{ 'ON' if value_json.muted else 'OFF' }}", "mdi:volume-off")
+	muted.PayloadOn, muted.PayloadOff = "ON", "OFF"
+
+	input := entity("select", "input", "Input", "{{ value_json.input }}", "mdi:video-input-hdmi")
+	input.Options = config.Capabilities.inputs()
+
+	entities := []mqttEntity{power, volume, muted, input}
+	// a text entity, as YNC can't list a model's DSP programs
+	if all || config.Capabilities.hasSoundPrograms(zone) {
+		entities = append(entities, entity("text", "sound_program", "Sound Program", "{{ value_json.soundProgram }}", "mdi:surround-sound"))
+	}
+	return entities
+}
+
+// command applies a message sent to a command topic (<prefix>/<id>/<zone>/<name>/set)
+func (b *mqttBridge) command(prefix, topic, payload string) {
+	parts := strings.Split(strings.TrimPrefix(topic, prefix+"/"), "/")
+	if len(parts) != 4 {
+		return
+	}
+	id, name := parts[0], parts[2]
+	config, device, err := b.driver.lookupAVR(id)
+	if err != nil {
+		log.Warningf("Ignoring MQTT command %s: %s", topic, err)
+		return
+	}
+	zone, err := strconv.Atoi(parts[1])
+	if err != nil || zone < 1 || zone > zoneCount(config) {
+		logFor(config).op("mqtt").with("topic", topic).Warningf("Ignoring MQTT command for a zone the AVR doesn't have")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(device.ctx, requestTimeout)
+	defer cancel()
+	if err := applyMQTTCommand(ctx, config, device, zone, name, payload); err != nil {
+		logFor(config).zone(zone).op("mqtt").with("command", name).with("payload", payload).with("error", err).Warningf("MQTT command failed")
+		return
+	}
+	logFor(config).zone(zone).op("mqtt").with("command", name).with("payload", payload).Debugf("MQTT command applied")
+	// publish the new state straight away rather than at the next poll
+	device.updateNow()
+}
+
+// applyMQTTCommand changes a zone with the same Device methods as the Ninja channels and the HTTP API
+func applyMQTTCommand(ctx context.Context, config *AVRConfig, device *Device, zone int, name, payload string) error {
+	onOff := func() (bool, error) {
+		switch strings.ToUpper(payload) {
+		case "ON":
+			return true, nil
+		case "OFF":
+			return false, nil
+		}
+		return false, fmt.Errorf("Expected ON or OFF")
+	}
+
+	switch name {
+	case "power":
+		on, err := onOff()
+		if err != nil {
+			return err
+		}
+		return device.switchPower(ctx, on, zone)
+	case "muted":
+		muted, err := onOff()
+		if err != nil {
+			return err
+		}
+		return device.setMuted(ctx, muted, zone)
+	case "volume":
+		volume, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return fmt.Errorf("Volume must be a number (dB), not %q", payload)
+		}
+		if err := ync.CheckVolume(volume, config.MaxVolume); err != nil {
+			return err
+		}
+		return device.setVolume(ctx, ync.ConformToClosest(volume, 0.5), zone)
+	case "input":
+		if err := ync.CheckInput(config.Name, payload, config.Capabilities.inputs()); err != nil {
+			return err
+		}
+		return device.setInput(ctx, payload, zone)
+	case "sound_program":
+		if err := ync.CheckSoundProgram(config.Name, zone, payload, config.Capabilities.hasSoundPrograms(zone)); err != nil {
+			return err
+		}
+		return device.setSoundProgram(ctx, payload, zone)
+	}
+	return fmt.Errorf("Unknown command %s", name)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync/ynctest"
+	"github.com/lindsaymarkward/go-avr-yamaha"
+)
+
+// testBroker is just enough of an MQTT 3.1.1 broker for the bridge, listening on localhost: QoS 0 and 1
+// publishes (delivered at QoS 0), retained messages, subscriptions with wildcards and pings
+type testBroker struct {
+	listener net.Listener
+
+	lock          sync.Mutex // guards everything below, and writes to the connections
+	retained      map[string]string
+	subscriptions map[net.Conn][]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{
+		listener:      listener,
+		retained:      make(map[string]string),
+		subscriptions: make(map[net.Conn][]string),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(b.close)
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testBroker) close() {
+	b.listener.Close()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for conn := range b.subscriptions {
+		conn.Close()
+	}
+}
+
+// message returns the retained message for a topic
+func (b *testBroker) message(topic string) (string, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+// subscribed returns whether a client has subscribed to filter
+func (b *testBroker) subscribed(filter string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, filters := range b.subscriptions {
+		for _, f := range filters {
+			if f == filter {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// publish retains (or with an empty payload, deletes) a message and sends it to every matching subscription
+func (b *testBroker) publish(topic, payload string, retain bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if retain && payload == "" {
+		delete(b.retained, topic)
+	} else if retain {
+		b.retained[topic] = payload
+	}
+	for conn, filters := range b.subscriptions {
+		for _, filter := range filters {
+			if topicMatches(filter, topic) {
+				writePacket(conn, 0x30, publishBody(topic, payload))
+				break
+			}
+		}
+	}
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer func() {
+		b.lock.Lock()
+		delete(b.subscriptions, conn)
+		b.lock.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		header, body, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT, accepted whatever it asks for
+			b.send(conn, 0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			topic, rest, err := readString(body)
+			if err != nil {
+				return
+			}
+			if qos := header >> 1 & 3; qos > 0 {
+				b.send(conn, 0x40, rest[:2])
+				rest = rest[2:]
+			}
+			b.publish(topic, string(rest), header&1 == 1)
+		case 8: // SUBSCRIBE, granting QoS 0 or 1, then the retained messages that match
+			id, rest := body[:2], body[2:]
+			granted := append([]byte{}, id...)
+			var filters []string
+			for len(rest) > 0 {
+				var filter string
+				if filter, rest, err = readString(rest); err != nil || len(rest) == 0 {
+					return
+				}
+				granted = append(granted, rest[0]&1)
+				filters, rest = append(filters, filter), rest[1:]
+			}
+			b.lock.Lock()
+			b.subscriptions[conn] = append(b.subscriptions[conn], filters...)
+			writePacket(conn, 0x90, granted)
+			for topic, payload := range b.retained {
+				for _, filter := range filters {
+					if topicMatches(filter, topic) {
+						writePacket(conn, 0x31, publishBody(topic, payload))
+						break
+					}
+				}
+			}
+			b.lock.Unlock()
+		case 10: // UNSUBSCRIBE
+			b.send(conn, 0xb0, body[:2])
+		case 12: // PINGREQ
+			b.send(conn, 0xd0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func (b *testBroker) send(conn net.Conn, header byte, body []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	writePacket(conn, header, body)
+}
+
+// readPacket reads an MQTT packet's first byte and the rest of it after the remaining length
+func readPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("remaining length too long")
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(reader, body)
+	return header, body, err
+}
+
+// writePacket writes an MQTT packet, ignoring errors as the client may have gone
+func writePacket(conn net.Conn, header byte, body []byte) {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	conn.Write(append(packet, body...))
+}
+
+func readString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, errors.New("short string")
+	}
+	length := int(data[0])<<8 | int(data[1])
+	if len(data) < 2+length {
+		return "", nil, errors.New("short string")
+	}
+	return string(data[2 : 2+length]), data[2+length:], nil
+}
+
+// publishBody is a QoS 0 PUBLISH's topic and payload
+func publishBody(topic, payload string) []byte {
+	body := []byte{byte(len(topic) >> 8), byte(len(topic))}
+	return append(append(body, topic...), payload...)
+}
+
+// topicMatches returns whether topic matches a subscription's filter, with + and # wildcards
+func topicMatches(filter, topic string) bool {
+	filters, topics := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i >= len(topics) || f != "+" && f != topics[i] {
+			return false
+		}
+	}
+	return len(filters) == len(topics)
+}
+
+// waitFor fails the test if done doesn't return true within a few seconds
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+// newTestBridge connects a test device's driver to a broker on localhost
+func newTestBridge(t *testing.T) (*testBroker, *Driver, *Device, *AVRConfig, *ynctest.Server) {
+	driver, device, config, avr, _ := newTestDevice(t)
+	config.Capabilities = Capabilities{
+		Detected:      true,
+		Features:      []string{"Main_Zone", "Zone_2", "Tuner"},
+		Inputs:        []string{"HDMI1", "TUNER", "NET RADIO"},
+		SoundPrograms: true,
+	}
+	driver.config.AVRs = map[string]*AVRConfig{config.ID: config}
+
+	broker := newTestBroker(t)
+	if err := driver.mqtt.start(MQTTConfig{Broker: broker.url()}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { driver.mqtt.start(MQTTConfig{}) })
+	waitFor(t, "the bridge to subscribe", func() bool { return broker.subscribed("yamaha-avr/+/+/+/set") })
+	return broker, driver, device, config, avr
+}
+
+func TestMQTTDiscovery(t *testing.T) {
+	broker, driver, _, config, _ := newTestBridge(t)
+	driver.mqtt.publishStates(config, map[int]ync.ZoneStatus{1: {}, 2: {}})
+
+	discovery := func(component, name string, zone int) (entity map[string]interface{}) {
+		topic := fmt.Sprintf("homeassistant/%s/yamaha_avr_TEST0001_zone_%d_%s/config", component, zone, name)
+		waitFor(t, topic, func() bool { _, ok := broker.message(topic); return ok })
+		payload, _ := broker.message(topic)
+		if err := json.Unmarshal([]byte(payload), &entity); err != nil {
+			t.Fatalf("%s: %s", topic, err)
+		}
+		return entity
+	}
+	power := discovery("switch", "power", 1)
+	if power["command_topic"] != "yamaha-avr/TEST0001/1/power/set" || power["state_topic"] != "yamaha-avr/TEST0001/1/state" ||
+		power["payload_on"] != "ON" || power["payload_off"] != "OFF" {
+		t.Errorf("power discovery = %v", power)
+	}
+	if device := power["device"].(map[string]interface{}); device["name"] != "Test AVR" {
+		t.Errorf("zone 1 device = %v, want the AVR's name", device)
+	}
+	volume := discovery("number", "volume", 1)
+	if volume["min"] != avryamaha.MinVolume || volume["max"] != config.MaxVolume || volume["step"] != 0.5 {
+		t.Errorf("volume discovery = %v, want %.1f to %.1f in 0.5 dB steps", volume, avryamaha.MinVolume, config.MaxVolume)
+	}
+	discovery("switch", "muted", 1)
+	input := discovery("select", "input", 2)
+	if options, _ := json.Marshal(input["options"]); string(options) != `["HDMI1","TUNER","NET RADIO"]` {
+		t.Errorf("input options = %s, want the detected inputs", options)
+	}
+	if device := input["device"].(map[string]interface{}); device["name"] != "Test AVR Zone 2" || device["via_device"] != "yamaha_avr_TEST0001_zone_1" {
+		t.Errorf("zone 2 device = %v", device)
+	}
+	discovery("text", "sound_program", 1)
+	// only the main zone has DSP programs
+	if payload, ok := broker.message("homeassistant/text/yamaha_avr_TEST0001_zone_2_sound_program/config"); ok {
+		t.Errorf("zone 2 has a sound program entity: %s", payload)
+	}
+	if payload, _ := broker.message("yamaha-avr/availability"); payload != "online" {
+		t.Errorf("bridge availability = %q, want online", payload)
+	}
+}
+
+func TestMQTTRetainsState(t *testing.T) {
+	broker, driver, _, config, _ := newTestBridge(t)
+	status := ync.ZoneStatus{Power: true, Volume: -35.5, Input: "NET RADIO", SoundProgram: "7ch Stereo"}
+	driver.mqtt.publishStates(config, map[int]ync.ZoneStatus{1: status})
+
+	topic := "yamaha-avr/TEST0001/1/state"
+	waitFor(t, topic, func() bool { _, ok := broker.message(topic); return ok })
+	payload, _ := broker.message(topic)
+	var state apiZone
+	if err := json.Unmarshal([]byte(payload), &state); err != nil {
+		t.Fatal(err)
+	}
+	if want := makeAPIZone(config, status); state != want {
+		t.Errorf("retained state = %+v, want %+v", state, want)
+	}
+
+	// the same state isn't published again, a new one replaces it
+	status.Muted = true
+	driver.mqtt.publishStates(config, map[int]ync.ZoneStatus{1: status})
+	waitFor(t, "the new state", func() bool { payload, _ := broker.message(topic); return strings.Contains(payload, `"muted":true`) })
+}
+
+func TestMQTTCommand(t *testing.T) {
+	broker, _, device, config, avr := newTestBridge(t)
+
+	broker.publish("yamaha-avr/TEST0001/1/power/set", "ON", false)
+	waitFor(t, "the power command", func() bool { return avr.Zone(1).Power })
+	// other zones aren't touched
+	if avr.Zone(2).Power {
+		t.Error("power/set for zone 1 turned on zone 2")
+	}
+
+	// commands are checked against the AVR's capabilities
+	if err := applyMQTTCommand(device.ctx, config, device, 2, "sound_program", "Standard"); err == nil {
+		t.Error("sound_program worked on zone 2, which has no DSP programs")
+	}
+	if err := applyMQTTCommand(device.ctx, config, device, 1, "input", "AV1"); err == nil {
+		t.Error("input worked with an input the AVR doesn't have")
+	}
+	if err := applyMQTTCommand(device.ctx, config, device, 1, "sound_program", "7ch Stereo"); err != nil {
+		t.Error(err)
+	} else if got := avr.Zone(1).SoundProgram; got != "7ch Stereo" {
+		t.Errorf("sound program = %s after sound_program 7ch Stereo", got)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// an AVR that's offline when it's first saved has no serial number (its ID) yet, so it's kept in
+// the config's Pending map by IP until it can be reached, then becomes a normal AVR and device
+
+// pendingRetryInterval is how often AVRs waiting to connect are tried
+const pendingRetryInterval = 30 * time.Second
+
+// addPending saves an AVR that couldn't be reached so it's added as soon as it can be,
+// an AVR already waiting at the same IP is replaced
+// the caller holds configLock
+func (d *Driver) addPending(avr AVRConfig) error {
+	logFor(&avr).op("addPending").Infof("AVR is offline, waiting for it to connect")
+	d.config.Pending[avr.IP] = &avr
+	return d.SendEvent("config", d.config)
+}
+
+// deletePending forgets an AVR that's waiting to connect
+// the caller holds configLock
+func (d *Driver) deletePending(ip string) error {
+	if _, ok := d.config.Pending[ip]; !ok {
+		return fmt.Errorf("No AVR is waiting to connect at %s", ip)
+	}
+	delete(d.config.Pending, ip)
+	return d.SendEvent("config", d.config)
+}
+
+// tryPending tries to reach the AVR waiting at ip, and stores it as a normal AVR if it can,
+// without holding configLock while waiting for the AVR, so config screens aren't held up by offline AVRs
+func (d *Driver) tryPending(ctx context.Context, ip string) error {
+	d.configLock.Lock()
+	pending, ok := d.config.Pending[ip]
+	d.configLock.Unlock()
+	if !ok {
+		return fmt.Errorf("No AVR is waiting to connect at %s", ip)
+	}
+	avr := *pending
+	if err := connect(ctx, &avr); err != nil {
+		logFor(&avr).op("tryPending").with("error", err).Debugf("AVR still isn't reachable")
+		return err
+	}
+
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	// it may have been deleted or re-saved with other details while we were waiting
+	if d.config.Pending[ip] != pending {
+		return nil
+	}
+	return d.promotePending(avr)
+}
+
+// promotePending stores a pending AVR that has been reached (so has its ID) as a normal AVR
+// the caller holds configLock
+func (d *Driver) promotePending(avr AVRConfig) error {
+	logFor(&avr).op("promotePending").with("model", avr.Model).Infof("AVR is online, adding it")
+	return d.storeAVR(avr)
+}
+
+// watchPending tries every AVR waiting to connect until the driver stops
+func (d *Driver) watchPending() {
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(pendingRetryInterval):
+		}
+
+		d.configLock.Lock()
+		var ips []string
+		for ip := range d.config.Pending {
+			ips = append(ips, ip)
+		}
+		d.configLock.Unlock()
+
+		for _, ip := range ips {
+			// tryPending logs the AVRs that are still unreachable
+			ctx, cancel := context.WithTimeout(d.ctx, requestTimeout)
+			d.tryPending(ctx, ip)
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+	"github.com/ninjasphere/go-ninja/channels"
+)
+
+// stateRefreshInterval is how often all states are re-sent to Ninja even if they haven't changed,
+// so anything that missed an update (e.g. the app reconnecting) catches up
+const stateRefreshInterval = 5 * time.Minute
+
+// a stateSink is where a device's states are published, its own Ninja channels (tests use a fake)
+type stateSink interface {
+	UpdateOnOffState(state bool) error
+	UpdateVolumeState(state *channels.VolumeState) error
+}
+
+// publishedState is what was last sent to Ninja for a device, so polling only publishes changes
+type publishedState struct {
+	sync.Mutex
+	zone        int // states belong to this zone; switching zones republishes everything
+	hasPower    bool
+	power       bool
+	hasVolume   bool
+	volume      float64
+	hasMuted    bool
+	muted       bool
+	lastRefresh time.Time
+}
+
+// refreshDue returns true if everything should be republished: the zone changed or it's been a while
+func (p *publishedState) refreshDue(zone int) bool {
+	p.Lock()
+	defer p.Unlock()
+	if zone != p.zone || time.Since(p.lastRefresh) > stateRefreshInterval {
+		p.zone = zone
+		p.lastRefresh = time.Now()
+		return true
+	}
+	return false
+}
+
+// publishOnOff sends the power state to Ninja if it changed since it was last sent (or force is set)
+func (d *Device) publishOnOff(state bool, force bool) {
+	d.published.Lock()
+	changed := force || !d.published.hasPower || d.published.power != state
+	d.published.hasPower, d.published.power = true, state
+	d.published.Unlock()
+
+	if changed {
+		d.sink.UpdateOnOffState(state)
+	}
+}
+
+// publishVolume sends the parts of the volume state that changed since they were last sent (or all of it if force is set)
+func (d *Device) publishVolume(state *channels.VolumeState, force bool) {
+	changes := &channels.VolumeState{}
+	d.published.Lock()
+	if state.Level != nil && (force || !d.published.hasVolume || d.published.volume != *state.Level) {
+		d.published.hasVolume, d.published.volume = true, *state.Level
+		changes.Level = state.Level
+	}
+	if state.Muted != nil && (force || !d.published.hasMuted || d.published.muted != *state.Muted) {
+		d.published.hasMuted, d.published.muted = true, *state.Muted
+		changes.Muted = state.Muted
+	}
+	d.published.Unlock()
+
+	if changes.Level != nil || changes.Muted != nil {
+		d.sink.UpdateVolumeState(changes)
+	}
+}
+
+// statusCache holds the latest status of every zone, filled in by the poller and kept up to date
+// by the handlers, so screens and IsOn don't need to ask the AVR
+type statusCache struct {
+	sync.Mutex
+	zones   map[int]ync.ZoneStatus
+	errors  map[int]error // zones that couldn't be read by the last poll
+	updated time.Time
+}
+
+// set records a poll's results: the status of the zones that were read, and the errors for those that
+// couldn't be (which keep their last status), returning the errors the previous poll had
+func (c *statusCache) set(zones map[int]ync.ZoneStatus, errors map[int]error) map[int]error {
+	c.Lock()
+	defer c.Unlock()
+	cached := make(map[int]ync.ZoneStatus)
+	for zone, status := range zones {
+		cached[zone] = status
+	}
+	for zone := range errors {
+		if status, ok := c.zones[zone]; ok {
+			cached[zone] = status
+		}
+	}
+	previous := c.errors
+	c.zones, c.errors = cached, errors
+	c.updated = time.Now()
+	return previous
+}
+
+// ZoneErrors returns the zones the last poll couldn't read, with why
+func (c *statusCache) ZoneErrors() map[int]error {
+	c.Lock()
+	defer c.Unlock()
+	errors := make(map[int]error)
+	for zone, err := range c.errors {
+		errors[zone] = err
+	}
+	return errors
+}
+
+// Zone returns the cached status of a zone, and false if it hasn't been read yet
+func (c *statusCache) Zone(zone int) (ync.ZoneStatus, bool) {
+	c.Lock()
+	defer c.Unlock()
+	status, ok := c.zones[zone]
+	return status, ok
+}
+
+// Updated returns when the cache was last filled by polling (zero if never)
+func (c *statusCache) Updated() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.updated
+}
+
+// update changes the cached status of a zone after a command succeeds (if the zone has been read)
+func (c *statusCache) update(zone int, change func(status *ync.ZoneStatus)) {
+	c.Lock()
+	defer c.Unlock()
+	if status, ok := c.zones[zone]; ok {
+		change(&status)
+		c.zones[zone] = status
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync/ynctest"
+	"github.com/lindsaymarkward/go-avr-yamaha"
+	"github.com/ninjasphere/go-ninja/channels"
+)
+
+// fakeSink records what a device publishes to Ninja
+type fakeSink struct {
+	onOff  []bool
+	volume []channels.VolumeState
+}
+
+func (s *fakeSink) UpdateOnOffState(state bool) error {
+	s.onOff = append(s.onOff, state)
+	return nil
+}
+
+func (s *fakeSink) UpdateVolumeState(state *channels.VolumeState) error {
+	s.volume = append(s.volume, *state)
+	return nil
+}
+
+// reset forgets what was published so far
+func (s *fakeSink) reset() {
+	s.onOff, s.volume = nil, nil
+}
+
+// newTestDevice makes a device for a fake AVR with two zones, without Ninja
+func newTestDevice(t *testing.T) (*Driver, *Device, *AVRConfig, *ynctest.Server, *fakeSink) {
+	avr := ynctest.NewServer()
+	t.Cleanup(avr.Close)
+	avr.SetZone(2, ynctest.Zone{Volume: -50, Input: "AV1"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	driver := &Driver{devices: make(map[string]*Device), ctx: ctx, stop: cancel}
+	driver.mqtt = newMQTTBridge(driver)
+	config := &AVRConfig{
+		AVR:       avryamaha.AVR{IP: avr.IP(), ID: "TEST0001", Name: "Test AVR"},
+		MaxVolume: 16.5,
+		Zones:     2,
+		Zone:      1,
+	}
+	sink := &fakeSink{}
+	device := &Device{driver: driver, config: config, client: newClient(avr.IP(), time.Second), sink: sink}
+	device.ctx, device.stop = context.WithCancel(ctx)
+	go device.client.Run(device.ctx)
+	driver.devices[config.ID] = device
+	return driver, device, config, avr, sink
+}
+
+// update polls the device like its poller does
+func update(t *testing.T, driver *Driver, device *Device, config *AVRConfig) {
+	t.Helper()
+	settings := driver.snapshot(config)
+	if err := driver.UpdateStates(context.Background(), device, &settings); err != nil {
+		t.Fatalf("UpdateStates failed: %s", err)
+	}
+}
+
+func TestUpdateStatesPublishesChangesOnce(t *testing.T) {
+	driver, device, config, avr, sink := newTestDevice(t)
+
+	// the first poll publishes everything
+	update(t, driver, device, config)
+	if len(sink.onOff) != 1 || len(sink.volume) != 1 {
+		t.Fatalf("first poll published %d on/off and %d volume states, want 1 each", len(sink.onOff), len(sink.volume))
+	}
+	sink.reset()
+
+	update(t, driver, device, config)
+	if len(sink.onOff) != 0 || len(sink.volume) != 0 {
+		t.Errorf("identical poll published %v and %v, want nothing", sink.onOff, sink.volume)
+	}
+
+	zone := avr.Zone(1)
+	zone.Power = true
+	avr.SetZone(1, zone)
+	update(t, driver, device, config)
+	update(t, driver, device, config)
+	if len(sink.onOff) != 1 || !sink.onOff[0] {
+		t.Errorf("power change published %v, want [true] once", sink.onOff)
+	}
+	if len(sink.volume) != 0 {
+		t.Errorf("power change published volume %v, want nothing", sink.volume)
+	}
+	sink.reset()
+
+	zone.Muted = true
+	avr.SetZone(1, zone)
+	update(t, driver, device, config)
+	update(t, driver, device, config)
+	if len(sink.volume) != 1 || sink.volume[0].Muted == nil || !*sink.volume[0].Muted || sink.volume[0].Level != nil {
+		t.Errorf("mute change published %+v, want just muted once", sink.volume)
+	}
+	if len(sink.onOff) != 0 {
+		t.Errorf("mute change published power %v, want nothing", sink.onOff)
+	}
+}
+
+func TestUpdateStatesRefreshes(t *testing.T) {
+	driver, device, config, _, sink := newTestDevice(t)
+	update(t, driver, device, config)
+	sink.reset()
+
+	// switching zones republishes everything, even if it's the same as the last zone's
+	driver.updateAVR(config, func(config *AVRConfig) { config.Zone = 2 })
+	update(t, driver, device, config)
+	if len(sink.onOff) != 1 || len(sink.volume) != 1 || sink.volume[0].Level == nil || sink.volume[0].Muted == nil {
+		t.Errorf("zone switch published %v and %+v, want every state", sink.onOff, sink.volume)
+	}
+	sink.reset()
+
+	update(t, driver, device, config)
+	if len(sink.onOff) != 0 || len(sink.volume) != 0 {
+		t.Errorf("identical poll after zone switch published %v and %v, want nothing", sink.onOff, sink.volume)
+	}
+
+	// so does a poll once stateRefreshInterval has passed
+	device.published.Lock()
+	device.published.lastRefresh = time.Now().Add(-stateRefreshInterval - time.Second)
+	device.published.Unlock()
+	update(t, driver, device, config)
+	if len(sink.onOff) != 1 || len(sink.volume) != 1 {
+		t.Errorf("refresh published %v and %+v, want every state", sink.onOff, sink.volume)
+	}
+}
+
+func TestUpdateStatesZoneErrors(t *testing.T) {
+	driver, device, config, avr, _ := newTestDevice(t)
+
+	// another zone failing doesn't fail the poll, it's recorded with the zone's last status
+	update(t, driver, device, config)
+	avr.Fail(2, true)
+	update(t, driver, device, config)
+	if errors := device.status.ZoneErrors(); errors[2] == nil || len(errors) != 1 {
+		t.Errorf("ZoneErrors() = %v, want just zone 2", errors)
+	}
+	if status, ok := device.status.Zone(2); !ok || status.Input != "AV1" {
+		t.Errorf("zone 2 status = %+v, %v, want its last status", status, ok)
+	}
+
+	avr.Fail(2, false)
+	update(t, driver, device, config)
+	if errors := device.status.ZoneErrors(); len(errors) != 0 {
+		t.Errorf("ZoneErrors() = %v after zone 2 recovered, want none", errors)
+	}
+
+	// the selected zone failing does
+	avr.Fail(1, true)
+	settings := driver.snapshot(config)
+	if err := driver.UpdateStates(context.Background(), device, &settings); err == nil {
+		t.Error("UpdateStates worked with the selected zone failing")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+// exporting and importing the AVRs' config (favourites, limits etc.), e.g. to move it to a new sphereamid
+// the driver's settings (HTTP API, MQTT, metrics) aren't exported or imported: they're for one sphereamid,
+// and the API token and MQTT password shouldn't be shown on the export screen
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// exportedConfig is the part of Config that's exported, with the same JSON names (so it can be imported by
+// this or a newer version)
+type exportedConfig struct {
+	Version int `json:"version,string"`
+	AVRs    map[string]*AVRConfig
+	Pending map[string]*AVRConfig `json:",omitempty"`
+}
+
+// exportConfig returns the AVRs in the driver's config as JSON, without the settings
+func (d *Driver) exportConfig() ([]byte, error) {
+	return json.Marshal(exportedConfig{
+		Version: configVersion,
+		AVRs:    d.config.AVRs,
+		Pending: d.config.Pending,
+	})
+}
+
+// hasSettings returns whether config has any of the settings that aren't imported
+// (config exported by older versions included them)
+func (c Config) hasSettings() bool {
+	return c.API != (APIConfig{}) || c.MQTT != (MQTTConfig{}) || c.Metrics != (MetricsConfig{})
+}
+
+// parseImport reads exported config (migrating it if it's from an older version) and checks every AVR in it
+// the same way as the edit form, problems describe anything that's wrong
+func parseImport(data string) (config Config, problems []string) {
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		return config, []string{fmt.Sprintf("Not valid config: %s", err)}
+	}
+	if config.Unmigrated != nil {
+		return config, []string{"The config couldn't be upgraded from its version (see the driver log)"}
+	}
+	if len(config.AVRs) == 0 && len(config.Pending) == 0 {
+		return config, []string{"There are no AVRs in the config"}
+	}
+
+	check := func(description string, avr *AVRConfig) {
+		if avr == nil {
+			problems = append(problems, description+": no details")
+			return
+		}
+		// the edit form's defaults, for config that left them out
+		if avr.UpdateInterval == 0 {
+			avr.UpdateInterval = defaultUpdateInterval
+		}
+		_, formProblems := validateAVR(avrFormValues(*avr))
+		var fields []string
+		for field := range formProblems {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			problems = append(problems, fmt.Sprintf("%s: %s", description, formProblems[field]))
+		}
+		names := make(map[string]bool)
+		for i, favourite := range avr.Favourites {
+			if favourite.Name == "" || favourite.Input == "" {
+				problems = append(problems, fmt.Sprintf("%s: favourite %d needs a name and input", description, i+1))
+			} else if names[favourite.Name] {
+				// favourites are played and deleted by name
+				problems = append(problems, fmt.Sprintf("%s: more than one favourite is called %q", description, favourite.Name))
+			}
+			names[favourite.Name] = true
+		}
+	}
+	for id, avr := range config.AVRs {
+		check("AVR "+id, avr)
+		if avr != nil && avr.ID != id {
+			problems = append(problems, fmt.Sprintf("AVR %s: has a different ID (%s)", id, avr.ID))
+		}
+	}
+	for ip, avr := range config.Pending {
+		check("AVR waiting at "+ip, avr)
+		if avr != nil && avr.IP != ip {
+			problems = append(problems, fmt.Sprintf("AVR waiting at %s: has a different IP (%s)", ip, avr.IP))
+		}
+	}
+	return config, problems
+}
+
+// importChanges describes what importing config would do, replace removes AVRs that aren't in it
+func (d *Driver) importChanges(config Config, replace bool) []string {
+	var changes []string
+	for id, avr := range config.AVRs {
+		favourites := strconv.Itoa(len(avr.Favourites)) + " favourites"
+		if existing, ok := d.config.AVRs[id]; ok {
+			changes = append(changes, fmt.Sprintf("Update %s (%s) - was %s at %s, %d favourites, now %s at %s, %s",
+				avr.Name, id, existing.Name, existing.IP, len(existing.Favourites), avr.Name, avr.IP, favourites))
+		} else {
+			changes = append(changes, fmt.Sprintf("Add %s (%s) at %s, %s", avr.Name, id, avr.IP, favourites))
+		}
+	}
+	for ip, avr := range config.Pending {
+		changes = append(changes, fmt.Sprintf("Wait for %s to connect at %s", avr.Name, ip))
+	}
+	if replace {
+		for id, avr := range d.config.AVRs {
+			if _, ok := config.AVRs[id]; !ok {
+				changes = append(changes, fmt.Sprintf("Delete %s (%s) and its %d favourites", avr.Name, id, len(avr.Favourites)))
+			}
+		}
+		for ip, avr := range d.config.Pending {
+			if _, ok := config.Pending[ip]; !ok {
+				changes = append(changes, fmt.Sprintf("Stop waiting for %s at %s", avr.Name, ip))
+			}
+		}
+	}
+	sort.Strings(changes)
+	if config.hasSettings() {
+		changes = append(changes, "Keep this Sphere's settings (HTTP API, MQTT and metrics) - settings in the config aren't imported")
+	}
+	return changes
+}
+
+// importConfig adds (or updates) every AVR in config, replace deletes the AVRs that aren't in it
+// config must have been checked by parseImport
+// the caller holds configLock
+func (d *Driver) importConfig(config Config, replace bool) error {
+	if replace {
+		for id := range d.config.AVRs {
+			if _, ok := config.AVRs[id]; !ok {
+				if err := d.deleteAVR(id); err != nil {
+					return err
+				}
+			}
+		}
+		for ip := range d.config.Pending {
+			if _, ok := config.Pending[ip]; !ok {
+				delete(d.config.Pending, ip)
+			}
+		}
+	}
+
+	for id, avr := range config.AVRs {
+		if avr.Zones == 0 {
+			avr.Zones = avr.ZonesOverride
+		}
+		// the edit form's fields are updated (or the device is created) the same way as saving the form,
+		// then everything else the form doesn't have
+		if err := d.storeAVR(*avr); err != nil {
+			return fmt.Errorf("Could not import AVR %s (%s): %s", avr.Name, id, err)
+		}
+		d.updateAVR(d.config.AVRs[id], func(stored *AVRConfig) {
+			stored.VolumeIncrement = avr.VolumeIncrement
+			stored.Favourites = avr.Favourites
+			if avr.Zone >= 1 && avr.Zone <= stored.Zones {
+				stored.Zone = avr.Zone
+			}
+		})
+	}
+	for ip, avr := range config.Pending {
+		d.config.Pending[ip] = avr
+	}
+	return d.SendEvent("config", d.config)
+}
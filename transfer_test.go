@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lindsaymarkward/go-avr-yamaha"
+)
+
+func TestExportLeavesOutSettings(t *testing.T) {
+	driver := &Driver{config: Config{
+		AVRs: map[string]*AVRConfig{"A1": &AVRConfig{
+			AVR:            avryamaha.AVR{ID: "A1", Name: "Lounge", IP: "192.168.1.20"},
+			MaxVolume:      -10,
+			UpdateInterval: 5,
+			Favourites:     []Favourite{{Name: "Jazz", Input: "NET RADIO", Path: []string{"Bookmarks", "Jazz"}}},
+		}},
+		API:  APIConfig{Port: 8090, Token: "api-secret"},
+		MQTT: MQTTConfig{Broker: "tcp://192.168.1.10:1883", Username: "ha", Password: "mqtt-secret"},
+	}}
+	data, err := driver.exportConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"api-secret", "mqtt-secret", "8090", "broker"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("export contains %q: %s", secret, data)
+		}
+	}
+
+	config, problems := parseImport(string(data))
+	if len(problems) > 0 {
+		t.Fatalf("exported config doesn't import: %v", problems)
+	}
+	if avr := config.AVRs["A1"]; avr == nil || len(avr.Favourites) != 1 || avr.Favourites[0].Path[1] != "Jazz" {
+		t.Errorf("imported AVR A1 = %+v, want it as exported", avr)
+	}
+	if config.hasSettings() {
+		t.Errorf("imported config has settings %+v %+v %+v", config.API, config.MQTT, config.Metrics)
+	}
+}
+
+// newImportDriver has two AVRs and one waiting to connect, without devices (as the importing
+// doesn't need them)
+func newImportDriver() *Driver {
+	driver := &Driver{devices: make(map[string]*Device)}
+	driver.mqtt = newMQTTBridge(driver)
+	driver.config = Config{
+		AVRs: map[string]*AVRConfig{
+			"A1": &AVRConfig{
+				AVR:        avryamaha.AVR{ID: "A1", Name: "Lounge", IP: "192.168.1.20"},
+				Zones:      1,
+				Zone:       1,
+				Favourites: []Favourite{{Name: "Jazz", Input: "NET RADIO"}},
+			},
+			"B2": &AVRConfig{AVR: avryamaha.AVR{ID: "B2", Name: "Deck", IP: "192.168.1.21"}, Zones: 1, Zone: 1},
+		},
+		Pending: map[string]*AVRConfig{
+			"192.168.1.30": &AVRConfig{AVR: avryamaha.AVR{Name: "Study", IP: "192.168.1.30"}},
+		},
+	}
+	return driver
+}
+
+func TestImport(t *testing.T) {
+	// A1 renamed with another favourite, and a new AVR waiting to connect
+	imported := `{"version": "2", "AVRs": {"A1": {"ID": "A1", "Name": "Living Room", "IP": "192.168.1.20",
+			"maxVolume": "-10", "updateInterval": "5", "zones": "1",
+			"favourites": [{"name": "Jazz", "input": "NET RADIO"}, {"name": "News", "input": "TUNER", "preset": 3}]}},
+		"Pending": {"192.168.1.40": {"Name": "Garage", "IP": "192.168.1.40", "maxVolume": "-10", "updateInterval": "5"}}}`
+	update := "Update Living Room (A1) - was Lounge at 192.168.1.20, 1 favourites, now Living Room at 192.168.1.20, 2 favourites"
+	wait := "Wait for Garage to connect at 192.168.1.40"
+
+	tests := []struct {
+		name        string
+		replace     bool
+		wantChanges []string
+		wantAVRs    []string // the IDs left afterwards
+		wantPending []string // the IPs left waiting afterwards
+	}{
+		{"merge", false, []string{update, wait}, []string{"A1", "B2"}, []string{"192.168.1.30", "192.168.1.40"}},
+		{"replace", true, []string{"Delete Deck (B2) and its 0 favourites", "Stop waiting for Study at 192.168.1.30", update, wait},
+			[]string{"A1"}, []string{"192.168.1.40"}},
+	}
+	for _, test := range tests {
+		config, problems := parseImport(imported)
+		if len(problems) > 0 {
+			t.Fatalf("%s: %v", test.name, problems)
+		}
+		driver := newImportDriver()
+		if changes := driver.importChanges(config, test.replace); strings.Join(changes, "\n") != strings.Join(test.wantChanges, "\n") {
+			t.Errorf("%s: preview =\n%s\nwant\n%s", test.name, strings.Join(changes, "\n"), strings.Join(test.wantChanges, "\n"))
+		}
+
+		// the preview has to match what importing does
+		if err := driver.importConfig(config, test.replace); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		var avrs, pending []string
+		for id := range driver.config.AVRs {
+			avrs = append(avrs, id)
+		}
+		for ip := range driver.config.Pending {
+			pending = append(pending, ip)
+		}
+		sort.Strings(avrs)
+		sort.Strings(pending)
+		if !reflect.DeepEqual(avrs, test.wantAVRs) || !reflect.DeepEqual(pending, test.wantPending) {
+			t.Errorf("%s: AVRs %v and pending %v after importing, want %v and %v", test.name, avrs, pending, test.wantAVRs, test.wantPending)
+		}
+		if a1 := driver.config.AVRs["A1"]; a1.Name != "Living Room" || len(a1.Favourites) != 2 || a1.Favourites[1].Preset != 3 {
+			t.Errorf("%s: A1 = %+v after importing, want it renamed with both favourites", test.name, a1)
+		}
+	}
+}
+
+func TestImportChangesAddsNewAVRs(t *testing.T) {
+	// new AVRs are only previewed here, importing them creates a Ninja device
+	config, problems := parseImport(`{"version": "2", "AVRs": {"C3": {"ID": "C3", "Name": "Kitchen", "IP": "192.168.1.50",
+		"maxVolume": "-10", "updateInterval": "5", "favourites": [{"name": "Jazz", "input": "NET RADIO"}]}}}`)
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	changes := newImportDriver().importChanges(config, false)
+	if want := []string{"Add Kitchen (C3) at 192.168.1.50, 1 favourites"}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("preview = %v, want %v", changes, want)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+)
+
+// limits for the values on the AVR edit form
+const (
+	maxZones          = ync.MaxZones
+	maxUpdateInterval = 3600
+	maxTimeout        = 60
+)
+
+// validateAVR checks the values posted by the edit form and converts them to an AVRConfig
+// problems maps each invalid field's name to a message saying what's wrong with it
+func validateAVR(values map[string]string) (config AVRConfig, problems map[string]string) {
+	problems = make(map[string]string)
+	value := func(name string) string {
+		return strings.TrimSpace(values[name])
+	}
+
+	config.ID = value("id")
+	config.Name = value("name")
+	if config.Name == "" {
+		problems["name"] = "Please enter a name"
+	}
+
+	config.IP = value("ip")
+	if ip := net.ParseIP(config.IP); ip == nil || ip.To4() == nil {
+		problems["ip"] = "Please enter an IP address like 192.168.1.20"
+	}
+
+	// zones are detected from the AVR unless they're set here
+	if value("zones") != "" {
+		zones, err := strconv.Atoi(value("zones"))
+		if err != nil || zones < 1 || zones > maxZones {
+			problems["zones"] = fmt.Sprintf("Zones must be a whole number from 1 to %d, or blank to detect them", maxZones)
+		}
+		config.ZonesOverride = zones
+	}
+
+	maxVolume, err := strconv.ParseFloat(value("maxVolume"), 64)
+	switch {
+	case err != nil:
+		problems["maxVolume"] = "Max volume must be a number (dB), e.g. -10.5"
+	default:
+		if err := ync.CheckMaxVolume(maxVolume); err != nil {
+			problems["maxVolume"] = err.Error()
+		}
+	}
+	config.MaxVolume = maxVolume
+
+	interval, err := strconv.Atoi(value("updateInterval"))
+	if err != nil || interval < 1 || interval > maxUpdateInterval {
+		problems["updateInterval"] = fmt.Sprintf("Update interval must be a whole number of seconds from 1 to %d", maxUpdateInterval)
+	}
+	config.UpdateInterval = interval
+
+	// timeout is optional, blank uses the default
+	if value("timeout") != "" {
+		timeout, err := strconv.ParseFloat(value("timeout"), 64)
+		if err != nil || timeout <= 0 || timeout > maxTimeout {
+			problems["timeout"] = fmt.Sprintf("Timeout must be a number of seconds above 0 and no more than %d", maxTimeout)
+		}
+		config.Timeout = timeout
+	}
+
+	if _, ok := parseLogLevel(value("logLevel")); !ok {
+		problems["logLevel"] = "Log level must be one of " + strings.Join(logLevels, ", ")
+	}
+	config.LogLevel = value("logLevel")
+	if config.LogLevel == defaultLogLevel {
+		config.LogLevel = ""
+	}
+
+	return config, problems
+}
+
+// avrFormValues converts an AVR's config to the values shown on the edit form
+func avrFormValues(config AVRConfig) map[string]string {
+	values := map[string]string{
+		"id":             config.ID,
+		"name":           config.Name,
+		"ip":             config.IP,
+		"zones":          "",
+		"maxVolume":      strconv.FormatFloat(config.MaxVolume, 'f', -1, 64),
+		"updateInterval": strconv.Itoa(config.UpdateInterval),
+		"timeout":        "",
+		"logLevel":       config.LogLevel,
+	}
+	if config.LogLevel == "" {
+		values["logLevel"] = defaultLogLevel
+	}
+	if config.ZonesOverride > 0 {
+		values["zones"] = strconv.Itoa(config.ZonesOverride)
+	}
+	if config.Timeout > 0 {
+		values["timeout"] = strconv.FormatFloat(config.Timeout, 'f', -1, 64)
+	}
+	return values
+}
+
+// validateSettings checks the values posted by the settings form, returning a Config with
+// just the settings filled in
+func validateSettings(values map[string]string) (settings Config, problems map[string]string) {
+	problems = make(map[string]string)
+	value := func(name string) string {
+		return strings.TrimSpace(values[name])
+	}
+	// port is optional, blank turns the feature off
+	port := func(name string) int {
+		if value(name) == "" {
+			return 0
+		}
+		port, err := strconv.Atoi(value(name))
+		if err != nil || port < 1 || port > 65535 {
+			problems[name] = "Port must be a whole number from 1 to 65535, or blank"
+		}
+		return port
+	}
+
+	settings.API.Port = port("apiPort")
+	settings.API.Token = value("apiToken")
+	settings.Metrics.Port = port("metricsPort")
+	if settings.Metrics.Port != 0 && settings.Metrics.Port == settings.API.Port {
+		problems["metricsPort"] = "Metrics need a different port to the API"
+	}
+
+	settings.MQTT.Broker = value("mqttBroker")
+	if settings.MQTT.Broker != "" && !validBrokerURL(settings.MQTT.Broker) {
+		problems["mqttBroker"] = "Broker must be a URL like tcp://192.168.1.10:1883, or blank"
+	}
+	settings.MQTT.Username = value("mqttUsername")
+	settings.MQTT.Password = values["mqttPassword"]
+	settings.MQTT.Prefix = strings.Trim(value("mqttPrefix"), "/")
+	settings.MQTT.DiscoveryPrefix = strings.Trim(value("mqttDiscoveryPrefix"), "/")
+	for _, name := range []string{"mqttPrefix", "mqttDiscoveryPrefix"} {
+		if strings.ContainsAny(value(name), "+#") {
+			problems[name] = "Topics can't have + or # in them"
+		}
+	}
+	return settings, problems
+}
+
+// settingsFormValues converts the driver's settings to the values shown on the settings form
+func settingsFormValues(config Config) map[string]string {
+	values := map[string]string{
+		"apiPort":  "",
+		"apiToken": config.API.Token,
+
+		"metricsPort": "",
+
+		"mqttBroker":          config.MQTT.Broker,
+		"mqttUsername":        config.MQTT.Username,
+		"mqttPassword":        config.MQTT.Password,
+		"mqttPrefix":          config.MQTT.Prefix,
+		"mqttDiscoveryPrefix": config.MQTT.DiscoveryPrefix,
+	}
+	if config.API.Port > 0 {
+		values["apiPort"] = strconv.Itoa(config.API.Port)
+	}
+	if config.Metrics.Port > 0 {
+		values["metricsPort"] = strconv.Itoa(config.Metrics.Port)
+	}
+	return values
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// validAVR is a valid edit form, for tests to change one field at a time
+func validAVR() map[string]string {
+	return map[string]string{
+		"id":             "A1",
+		"name":           "Lounge",
+		"ip":             "192.168.1.20",
+		"zones":          "2",
+		"maxVolume":      "-10.5",
+		"updateInterval": "5",
+		"timeout":        "2.5",
+		"logLevel":       "debug",
+	}
+}
+
+func TestValidateAVR(t *testing.T) {
+	tests := []struct {
+		field, value string
+		problem      bool
+	}{
+		{"name", "", true},
+		{"name", "  ", true},
+		{"ip", "192.168.1", true},
+		{"ip", "192.168.1.256", true},
+		{"ip", "lounge.local", true},
+		{"ip", "::1", true},
+		{"ip", " 192.168.1.21 ", false},
+		{"zones", "0", true},
+		{"zones", "50", true},
+		{"zones", "two", true},
+		{"zones", "4", false},
+		{"zones", "", false},
+		{"maxVolume", "17", true},
+		{"maxVolume", "16.5", false},
+		{"maxVolume", "-10.3", true},
+		{"maxVolume", "-100", true},
+		{"maxVolume", "loud", true},
+		{"maxVolume", "", true},
+		{"updateInterval", "0", true},
+		{"updateInterval", "-5", true},
+		{"updateInterval", "1.5", true},
+		{"updateInterval", "3601", true},
+		{"updateInterval", "3600", false},
+		{"timeout", "0", true},
+		{"timeout", "61", true},
+		{"timeout", "", false},
+		{"logLevel", "verbose", true},
+		{"logLevel", "", false},
+	}
+	for _, test := range tests {
+		values := validAVR()
+		values[test.field] = test.value
+		_, problems := validateAVR(values)
+		_, got := problems[test.field]
+		if got != test.problem {
+			t.Errorf("%s %q: problem = %v (%q), want %v", test.field, test.value, got, problems[test.field], test.problem)
+		}
+		// only the changed field has a problem
+		delete(problems, test.field)
+		if len(problems) > 0 {
+			t.Errorf("%s %q: other problems %v", test.field, test.value, problems)
+		}
+	}
+}
+
+func TestAVRFormValuesKeepPostedValues(t *testing.T) {
+	posted := validAVR()
+	config, problems := validateAVR(posted)
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	if values := avrFormValues(config); !reflect.DeepEqual(values, posted) {
+		t.Errorf("avrFormValues = %v, want the posted %v", values, posted)
+	}
+
+	// blank optional fields and the default log level come back as they're shown on a new form
+	posted["zones"], posted["timeout"], posted["logLevel"] = "", "", "info"
+	config, _ = validateAVR(posted)
+	if config.ZonesOverride != 0 || config.Timeout != 0 || config.LogLevel != "" {
+		t.Errorf("config = %+v, want zones detected, the default timeout and log level", config)
+	}
+	if values := avrFormValues(config); !reflect.DeepEqual(values, posted) {
+		t.Errorf("avrFormValues = %v, want the posted %v", values, posted)
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	valid := func() map[string]string {
+		return map[string]string{
+			"apiPort":             "8090",
+			"apiToken":            "secret",
+			"metricsPort":         "9100",
+			"mqttBroker":          "tcp://192.168.1.10:1883",
+			"mqttUsername":        "ha",
+			"mqttPassword":        " spaces kept ",
+			"mqttPrefix":          "yamaha-avr",
+			"mqttDiscoveryPrefix": "homeassistant",
+		}
+	}
+	tests := []struct {
+		field, value string
+		problem      string // the field with a problem, if any
+	}{
+		{"apiPort", "", ""},
+		{"apiPort", "0", "apiPort"},
+		{"apiPort", "65536", "apiPort"},
+		{"apiPort", "http", "apiPort"},
+		{"metricsPort", "8090", "metricsPort"},
+		{"metricsPort", "", ""},
+		{"mqttBroker", "192.168.1.10:1883", "mqttBroker"},
+		{"mqttBroker", "http://192.168.1.10", "mqttBroker"},
+		{"mqttBroker", "", ""},
+		{"mqttPrefix", "yamaha/#", "mqttPrefix"},
+		{"mqttDiscoveryPrefix", "home+assistant", "mqttDiscoveryPrefix"},
+	}
+	for _, test := range tests {
+		values := valid()
+		values[test.field] = test.value
+		_, problems := validateSettings(values)
+		_, got := problems[test.problem]
+		if test.problem == "" && len(problems) > 0 || test.problem != "" && (!got || len(problems) != 1) {
+			t.Errorf("%s %q: problems %v, want only %q", test.field, test.value, problems, test.problem)
+		}
+	}
+
+	settings, problems := validateSettings(valid())
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	if values := settingsFormValues(settings); !reflect.DeepEqual(values, valid()) {
+		t.Errorf("settingsFormValues = %v, want the posted %v", values, valid())
+	}
+}
@@ -0,0 +1,59 @@
+package ync
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/lindsaymarkward/go-avr-yamaha"
+)
+
+// the checks made before a command is sent to an AVR, shared by the driver (its control screen, API and
+// MQTT) and the command-line tool so they accept and refuse the same things
+
+// DefaultInputs are the inputs offered for AVRs that couldn't list their own
+var DefaultInputs = []string{"NET RADIO", "SERVER", "TUNER", "AUDIO1", "AUDIO2", "V-AUX", "USB", "DOCK", "PC"}
+
+// CheckMaxVolume returns an error unless max is a usable volume limit (dB) for an AVR
+func CheckMaxVolume(max float64) error {
+	if max <= avryamaha.MinVolume || max > avryamaha.MaxVolume {
+		return fmt.Errorf("Max volume must be above %.1f and no more than %.1f dB", avryamaha.MinVolume, avryamaha.MaxVolume)
+	}
+	if math.Mod(max*10, 5) != 0 {
+		return fmt.Errorf("Max volume must be a multiple of 0.5")
+	}
+	return nil
+}
+
+// CheckVolume returns an error unless volume (dB) is from the lowest volume to max, the AVR's limit
+func CheckVolume(volume, max float64) error {
+	if volume < avryamaha.MinVolume || volume > max {
+		return fmt.Errorf("Volume must be from %.1f to %.1f dB", avryamaha.MinVolume, max)
+	}
+	return nil
+}
+
+// CheckInput returns an error unless input is one of inputs, the ones the AVR (called name) has
+func CheckInput(name, input string, inputs []string) error {
+	for _, i := range inputs {
+		if i == input {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s doesn't have input %s", name, input)
+}
+
+// HasSoundPrograms returns whether a zone has DSP programs given the main zone's status,
+// YNC has no list of them, but only models with them report the main zone's current one,
+// and only the main zone has them
+func HasSoundPrograms(zone int, mainZone ZoneStatus) bool {
+	return zone <= 1 && mainZone.SoundProgram != ""
+}
+
+// CheckSoundProgram returns an error unless the zone of the AVR (called name) has DSP programs and program
+// names one
+func CheckSoundProgram(name string, zone int, program string, hasPrograms bool) error {
+	if !hasPrograms || program == "" {
+		return fmt.Errorf("Zone %d of %s doesn't have DSP program %q", zone, name, program)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package ync_test
+
+import (
+	"testing"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+)
+
+func TestCheckMaxVolume(t *testing.T) {
+	tests := []struct {
+		max float64
+		ok  bool
+	}{
+		{-10, true},
+		{16.5, true},
+		{-80, true},
+		{-80.5, false},
+		{17, false},
+		{-10.25, false},
+	}
+	for _, test := range tests {
+		if err := ync.CheckMaxVolume(test.max); (err == nil) != test.ok {
+			t.Errorf("CheckMaxVolume(%v) = %v, want ok %v", test.max, err, test.ok)
+		}
+	}
+}
+
+func TestCheckVolume(t *testing.T) {
+	tests := []struct {
+		volume, max float64
+		ok          bool
+	}{
+		{-40, -10, true},
+		{-10, -10, true},
+		{-80.5, -10, true},
+		{-9.5, -10, false},
+		{-81, -10, false},
+	}
+	for _, test := range tests {
+		if err := ync.CheckVolume(test.volume, test.max); (err == nil) != test.ok {
+			t.Errorf("CheckVolume(%v, %v) = %v, want ok %v", test.volume, test.max, err, test.ok)
+		}
+	}
+}
+
+func TestCheckInput(t *testing.T) {
+	inputs := []string{"HDMI1", "NET RADIO"}
+	if err := ync.CheckInput("Lounge", "NET RADIO", inputs); err != nil {
+		t.Errorf("CheckInput(NET RADIO) = %s, want nil", err)
+	}
+	err := ync.CheckInput("Lounge", "HDMI2", inputs)
+	if err == nil || err.Error() != "Lounge doesn't have input HDMI2" {
+		t.Errorf("CheckInput(HDMI2) = %v, want Lounge doesn't have input HDMI2", err)
+	}
+}
+
+func TestCheckSoundProgram(t *testing.T) {
+	withProgram := ync.ZoneStatus{SoundProgram: "Standard"}
+	tests := []struct {
+		zone     int
+		mainZone ync.ZoneStatus
+		program  string
+		ok       bool
+	}{
+		{1, withProgram, "7ch Stereo", true},
+		{1, withProgram, "", false},
+		{2, withProgram, "Standard", false},
+		{1, ync.ZoneStatus{}, "Standard", false},
+	}
+	for _, test := range tests {
+		programs := ync.HasSoundPrograms(test.zone, test.mainZone)
+		err := ync.CheckSoundProgram("Lounge", test.zone, test.program, programs)
+		if (err == nil) != test.ok {
+			t.Errorf("CheckSoundProgram(zone %d, %q) = %v, want ok %v", test.zone, test.program, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Package ync controls Yamaha AV Receivers using YNC (Yamaha Network Control), through go-avr-yamaha and
+// raw YNC requests for the parts of the protocol it doesn't cover
+// it has nothing to do with Ninja, so the driver and the command-line tool (cmd/avr-yamaha) both use it
+package ync
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/lindsaymarkward/go-avr-yamaha"
+)
+
+// DefaultTimeout is used for AVRs that don't have a timeout set
+const DefaultTimeout = 3 * time.Second
+
+// a Client makes every request to one AVR with a deadline, whether it goes through the
+// go-avr-yamaha library or our own YNC requests
+// the library has no way to cancel a request, so its calls run in a goroutine that we stop waiting for,
+// and the next request waits for it to finish (set http.DefaultClient's timeout so they can't hang forever)
+// requests go through the queue (if there is one) so only one is sent to the AVR at a time
+type Client struct {
+	avr       *avryamaha.AVR
+	timeout   time.Duration
+	queue     *commandQueue
+	stats     *requestStats
+	lock      sync.Mutex
+	abandoned chan struct{} // closed when the library call we last gave up on returns
+}
+
+// NewClient makes a client for the AVR at ip, it needs Run before it can be used
+func NewClient(ip string, timeout time.Duration) *Client {
+	return &Client{avr: &avryamaha.AVR{IP: ip}, timeout: timeout, queue: newCommandQueue(), stats: &requestStats{}}
+}
+
+// NewUnqueuedClient makes a client that sends requests straight away (no Run needed), for one-off requests
+// like reading an AVR's details (GetXMLData fills them in avr) before it's saved
+func NewUnqueuedClient(avr *avryamaha.AVR, timeout time.Duration) *Client {
+	return &Client{avr: avr, timeout: timeout, stats: &requestStats{}}
+}
+
+// Run sends queued requests until ctx is done
+func (c *Client) Run(ctx context.Context) {
+	c.queue.work(ctx)
+}
+
+// QueueStats returns the client's queue counters
+func (c *Client) QueueStats() QueueStats {
+	if c.queue == nil {
+		return QueueStats{}
+	}
+	return c.queue.Stats()
+}
+
+// IP returns the address of the AVR
+func (c *Client) IP() string {
+	return c.avr.IP
+}
+
+// Timeout returns how long the client waits for each request
+func (c *Client) Timeout() time.Duration {
+	return c.timeout
+}
+
+// queued runs f through the queue, or straight away for clients without one,
+// recording how long it took and whether it failed (unless ctx was cancelled, which isn't the AVR's fault)
+func (c *Client) queued(ctx context.Context, key string, f func(ctx context.Context) error) error {
+	measured := func(ctx context.Context) error {
+		c.settle()
+		start := time.Now()
+		err := f(ctx)
+		if err == nil || ctx.Err() == nil {
+			c.stats.record(priorityOf(ctx), time.Since(start), err)
+		}
+		return err
+	}
+	if c.queue == nil {
+		return measured(ctx)
+	}
+	return c.queue.do(ctx, key, measured)
+}
+
+// call runs a library call, giving up when the per-call timeout passes or ctx is cancelled
+func (c *Client) call(ctx context.Context, f func() error) error {
+	return c.callKeyed(ctx, "", f)
+}
+
+// callKeyed is call for commands that replace earlier ones with the same key still in the queue
+func (c *Client) callKeyed(ctx context.Context, key string, f func() error) error {
+	return c.queued(ctx, key, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+
+		done := make(chan error, 1)
+		finished := make(chan struct{})
+		go func() {
+			done <- f()
+			close(finished)
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			c.lock.Lock()
+			c.abandoned = finished
+			c.lock.Unlock()
+			return ctx.Err()
+		}
+	})
+}
+
+// settle waits for a library call that was given up on to return, so it doesn't overlap the next request
+// (and a retry isn't sent while the AVR may still be answering the first try)
+func (c *Client) settle() {
+	c.lock.Lock()
+	abandoned := c.abandoned
+	c.lock.Unlock()
+	if abandoned != nil {
+		<-abandoned
+	}
+}
+
+// Request sends one of our own YNC requests (cmd is "GET" or "PUT") with the per-call timeout
+func (c *Client) Request(ctx context.Context, cmd, body string) (data []byte, err error) {
+	err = c.queued(ctx, "", func(ctx context.Context) (err error) {
+		ctx, cancel := context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+		data, err = request(ctx, c.avr.IP, cmd, body)
+		return err
+	})
+	return data, err
+}
+
+func (c *Client) GetPower(ctx context.Context, zone int) (on bool, err error) {
+	err = Retry(ctx, func() error {
+		return c.call(ctx, func() (err error) {
+			on, err = c.avr.GetPower(zone)
+			return err
+		})
+	})
+	return on, err
+}
+
+func (c *Client) SetPower(ctx context.Context, on bool, zone int) error {
+	return Retry(ctx, func() error {
+		return c.call(ctx, func() error {
+			return c.avr.SetPower(on, zone)
+		})
+	})
+}
+
+// TogglePower reads the zone's power and sets the opposite (rather than using the AVR's toggle)
+// so it can be retried without undoing itself, returns the new power state
+func (c *Client) TogglePower(ctx context.Context, zone int) (bool, error) {
+	status, err := c.ReadStatus(ctx, zone)
+	if err != nil {
+		return false, err
+	}
+	return !status.Power, c.SetPower(ctx, !status.Power, zone)
+}
+
+// SetVolume sets an absolute volume (in tenths of a dB), only the latest of several waiting
+// volume changes for a zone is sent
+func (c *Client) SetVolume(ctx context.Context, volume int, zone int) error {
+	return Retry(ctx, func() error {
+		return c.callKeyed(ctx, fmt.Sprintf("volume:%d", zone), func() error {
+			return c.avr.SetVolume(volume, zone)
+		})
+	})
+}
+
+// ChangeVolume reads the zone's volume and sets it change dB higher (or lower), no higher than max,
+// so it can be retried without changing the volume twice, returns the new volume in dB
+func (c *Client) ChangeVolume(ctx context.Context, change, max float64, zone int) (float64, error) {
+	status, err := c.ReadStatus(ctx, zone)
+	if err != nil {
+		return 0, err
+	}
+	volume := math.Max(math.Min(status.Volume+change, max), avryamaha.MinVolume)
+	// the AVR only takes multiples of 0.5 dB
+	volume = ConformToClosest(volume, 0.5)
+	return volume, c.SetVolume(ctx, int(volume*10), zone)
+}
+
+// SetMuted mutes or unmutes a zone (go-avr-yamaha can only toggle)
+func (c *Client) SetMuted(ctx context.Context, muted bool, zone int) error {
+	value := "Off"
+	if muted {
+		value = "On"
+	}
+	element := ZoneElement(zone)
+	return Retry(ctx, func() error {
+		_, err := c.Request(ctx, "PUT", "<"+element+"><Volume><Mute>"+value+"</Mute></Volume></"+element+">")
+		return err
+	})
+}
+
+// ToggleMuted reads whether the zone is muted and sets the opposite, returns the new mute state
+func (c *Client) ToggleMuted(ctx context.Context, zone int) (bool, error) {
+	status, err := c.ReadStatus(ctx, zone)
+	if err != nil {
+		return false, err
+	}
+	return !status.Muted, c.SetMuted(ctx, !status.Muted, zone)
+}
+
+func (c *Client) SetInput(ctx context.Context, input string, zone int) error {
+	return Retry(ctx, func() error {
+		return c.call(ctx, func() error {
+			return c.avr.SetInput(input, zone)
+		})
+	})
+}
+
+// ReadStatus is ZoneStatus with retries, for reading the current state before changing it
+func (c *Client) ReadStatus(ctx context.Context, zone int) (status ZoneStatus, err error) {
+	err = Retry(ctx, func() (err error) {
+		status, err = c.ZoneStatus(ctx, zone)
+		return err
+	})
+	return status, err
+}
+
+// GetXMLData reads the AVR's details (model, serial number) into the client's AVR
+func (c *Client) GetXMLData(ctx context.Context) error {
+	return c.call(ctx, c.avr.GetXMLData)
+}
+
+// ConformToClosest rounds value down to a multiple of step (e.g. volumes are in steps of 0.5 dB)
+func ConformToClosest(value, step float64) float64 {
+	multiples := int(value / step)
+	newValue := float64(multiples) * step
+	return roundPlaces(newValue, 2)
+}
+
+func roundPlaces(f float64, places int) float64 {
+	shift := math.Pow(10, float64(places))
+	return round(f*shift) / shift
+}
+
+func round(f float64) float64 {
+	return math.Floor(f + .5)
+}
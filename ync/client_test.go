@@ -0,0 +1,49 @@
+package ync
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a library call that outlives its timeout must not overlap the next request (e.g. its retry)
+func TestAbandonedCallBlocksQueue(t *testing.T) {
+	client := NewClient("192.0.2.1", 20*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Run(ctx)
+
+	var running, overlapped int32
+	slow := func() error {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+
+	if err := client.call(ctx, slow); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("slow call returned %v, want a timeout", err)
+	}
+	start := time.Now()
+	if err := client.call(ctx, slow); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("second slow call returned %v, want a timeout", err)
+	}
+	if err := client.call(ctx, func() error {
+		if atomic.LoadInt32(&running) > 0 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&overlapped) != 0 {
+		t.Error("a request was sent while an abandoned call was still running")
+	}
+	if time.Since(start) < 150*time.Millisecond {
+		t.Error("the queue didn't wait for the abandoned calls")
+	}
+}
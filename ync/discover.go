@@ -0,0 +1,120 @@
+package ync
+
+// finding AVRs on the local network with SSDP (UPnP discovery)
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpAddress = "239.255.255.250:1900"
+	// Yamaha network receivers announce themselves as UPnP media renderers
+	ssdpSearch = "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddress + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:MediaRenderer:1\r\n\r\n"
+)
+
+// a Receiver is an AVR found by Discover
+type Receiver struct {
+	IP    string
+	Name  string // the name set on the AVR (its UPnP friendly name)
+	Model string
+}
+
+// Discover searches the network for Yamaha AVRs, waiting up to wait (or until ctx is done) for replies
+func Discover(ctx context.Context, wait time.Duration) ([]Receiver, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	address, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo([]byte(ssdpSearch), address); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	// every device on the network may answer, often more than once, so read them all first
+	locations := make(map[string]bool)
+	buffer := make([]byte, 2048)
+	for ctx.Err() == nil {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			// the deadline has passed
+			break
+		}
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		response.Body.Close()
+		if location := response.Header.Get("Location"); location != "" {
+			locations[location] = true
+		}
+	}
+
+	var receivers []Receiver
+	for location := range locations {
+		if receiver, ok := describe(ctx, location); ok {
+			receivers = append(receivers, receiver)
+		}
+	}
+	return receivers, ctx.Err()
+}
+
+// describe reads a UPnP device description, returning false if it isn't a Yamaha AVR
+func describe(ctx context.Context, location string) (Receiver, bool) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return Receiver{}, false
+	}
+	request, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return Receiver{}, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return Receiver{}, false
+	}
+	defer resp.Body.Close()
+
+	var description struct {
+		Device struct {
+			Manufacturer string `xml:"manufacturer"`
+			ModelName    string `xml:"modelName"`
+			FriendlyName string `xml:"friendlyName"`
+		} `xml:"device"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&description); err != nil {
+		return Receiver{}, false
+	}
+	if !strings.Contains(description.Device.Manufacturer, "Yamaha") {
+		return Receiver{}, false
+	}
+	return Receiver{
+		IP:    u.Hostname(),
+		Name:  description.Device.FriendlyName,
+		Model: description.Device.ModelName,
+	}, true
+}
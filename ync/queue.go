@@ -0,0 +1,148 @@
+package ync
+
+import (
+	"context"
+	"sync"
+)
+
+// some Yamaha firmware drops requests that overlap, so every request to an AVR goes through
+// a queue with a single worker - user commands (Ninja channels, Labs) go ahead of polling
+
+// Priority orders requests waiting in an AVR's queue
+type Priority int
+
+const (
+	UserPriority Priority = iota
+	PollPriority
+	numPriorities
+)
+
+type priorityKey struct{}
+
+// WithPriority marks requests made with ctx as having the given priority (the default is UserPriority)
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityOf(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return UserPriority
+}
+
+// a command is a request waiting in the queue, waiters get the result when it has run
+type command struct {
+	key     string // commands with the same (non-empty) key replace each other while waiting
+	ctx     context.Context
+	run     func(ctx context.Context) error
+	waiters []chan error
+}
+
+// QueueStats are counters describing how busy an AVR's queue is
+type QueueStats struct {
+	Depth     int    // commands currently waiting
+	MaxDepth  int    // most commands ever waiting at once
+	Processed uint64 // commands run
+	Coalesced uint64 // commands replaced by a later one with the same key before they ran
+}
+
+// commandQueue runs commands for one AVR one at a time
+type commandQueue struct {
+	sync.Mutex
+	pending [numPriorities][]*command
+	wake    chan struct{}
+	stats   QueueStats
+}
+
+func newCommandQueue() *commandQueue {
+	return &commandQueue{wake: make(chan struct{}, 1)}
+}
+
+// do queues f and waits for it to run, returning its error (or ctx's if ctx is done first)
+// if key is set and a command with the same key is still waiting, f replaces it (e.g. only the last
+// of several volume changes is sent) and both callers get f's result
+func (q *commandQueue) do(ctx context.Context, key string, f func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+	p := priorityOf(ctx)
+
+	q.Lock()
+	queued := false
+	if key != "" {
+		for _, pending := range q.pending[p] {
+			if pending.key == key {
+				pending.ctx, pending.run = ctx, f
+				pending.waiters = append(pending.waiters, done)
+				q.stats.Coalesced++
+				queued = true
+				break
+			}
+		}
+	}
+	if !queued {
+		q.pending[p] = append(q.pending[p], &command{key: key, ctx: ctx, run: f, waiters: []chan error{done}})
+		q.stats.Depth++
+		if q.stats.Depth > q.stats.MaxDepth {
+			q.stats.MaxDepth = q.stats.Depth
+		}
+	}
+	q.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// next removes the highest priority waiting command, or returns nil if there isn't one
+func (q *commandQueue) next() *command {
+	q.Lock()
+	defer q.Unlock()
+	for p := range q.pending {
+		if len(q.pending[p]) > 0 {
+			c := q.pending[p][0]
+			q.pending[p] = q.pending[p][1:]
+			q.stats.Depth--
+			return c
+		}
+	}
+	return nil
+}
+
+// work runs queued commands until ctx is done
+func (q *commandQueue) work(ctx context.Context) {
+	for {
+		for c := q.next(); c != nil; c = q.next() {
+			// don't bother sending a command nobody is waiting for any more
+			err := c.ctx.Err()
+			if err == nil {
+				err = c.run(c.ctx)
+			}
+			q.Lock()
+			q.stats.Processed++
+			q.Unlock()
+			for _, waiter := range c.waiters {
+				waiter <- err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		}
+	}
+}
+
+// Stats returns a copy of the queue's counters
+func (q *commandQueue) Stats() QueueStats {
+	q.Lock()
+	defer q.Unlock()
+	return q.stats
+}
@@ -0,0 +1,37 @@
+package ync
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// idempotent commands (and reads) are retried a few times so a single dropped request doesn't fail
+// a user's action, relative commands (volume up, toggles) are done as read-then-set so they can be too
+const (
+	retryAttempts  = 3
+	retryBaseDelay = 250 * time.Millisecond
+)
+
+// Retry runs f until it succeeds, up to retryAttempts times, waiting a doubling delay with
+// random jitter between attempts - f must be safe to repeat
+func Retry(ctx context.Context, f func() error) error {
+	delay := retryBaseDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || attempt == retryAttempts {
+			return err
+		}
+		// give up straight away if it was the caller that gave up
+		if ctx.Err() != nil {
+			return err
+		}
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,70 @@
+package ync
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds (in seconds) of the request latency histogram
+var LatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// RequestStats count the requests sent to an AVR (whether they failed, including timeouts)
+// and how long they took
+type RequestStats struct {
+	Sent    uint64
+	Failed  uint64
+	Latency []uint64 // requests that took up to each of LatencyBuckets (not cumulative), the last is the rest
+	Seconds float64  // total time taken by every request
+}
+
+func (p Priority) String() string {
+	switch p {
+	case UserPriority:
+		return "user"
+	case PollPriority:
+		return "poll"
+	}
+	return "unknown"
+}
+
+// requestStats are a client's RequestStats for each priority
+type requestStats struct {
+	sync.Mutex
+	byPriority [numPriorities]RequestStats
+}
+
+func (s *requestStats) record(p Priority, took time.Duration, err error) {
+	s.Lock()
+	defer s.Unlock()
+	stats := &s.byPriority[p]
+	if stats.Latency == nil {
+		stats.Latency = make([]uint64, len(LatencyBuckets)+1)
+	}
+	stats.Sent++
+	if err != nil {
+		stats.Failed++
+	}
+	seconds := took.Seconds()
+	stats.Seconds += seconds
+	bucket := 0
+	for bucket < len(LatencyBuckets) && seconds > LatencyBuckets[bucket] {
+		bucket++
+	}
+	stats.Latency[bucket]++
+}
+
+// RequestStats returns the client's request counters for each priority (user commands and polling)
+func (c *Client) RequestStats() map[Priority]RequestStats {
+	c.stats.Lock()
+	defer c.stats.Unlock()
+	stats := make(map[Priority]RequestStats)
+	for p, s := range c.stats.byPriority {
+		if s.Latency == nil {
+			s.Latency = make([]uint64, len(LatencyBuckets)+1)
+		} else {
+			s.Latency = append([]uint64(nil), s.Latency...)
+		}
+		stats[Priority(p)] = s
+	}
+	return stats
+}
@@ -0,0 +1,263 @@
+package ync
+
+// raw YNC (Yamaha Network Control) requests for the parts of the protocol
+// that go-avr-yamaha doesn't cover (list browsing etc.)
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const yncPath = "/YamahaRemoteControl/ctrl"
+
+// yncResponse is the envelope every YNC reply is wrapped in, RC is 0 on success
+type yncResponse struct {
+	RC string `xml:"RC,attr"`
+}
+
+// request sends a YNC command (cmd is "GET" or "PUT") with the given XML body to the AVR at ip
+// and returns the raw response, the request is abandoned if ctx is cancelled
+func request(ctx context.Context, ip, cmd, body string) ([]byte, error) {
+	payload := `<?xml version="1.0" encoding="utf-8"?><YAMAHA_AV cmd="` + cmd + `">` + body + `</YAMAHA_AV>`
+	request, err := http.NewRequest("POST", "http://"+ip+yncPath, strings.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "text/xml")
+	resp, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var envelope yncResponse
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid YNC response from %s: %s", ip, err)
+	}
+	if envelope.RC != "0" {
+		return nil, fmt.Errorf("YNC %s request to %s failed with RC %s", cmd, ip, envelope.RC)
+	}
+	return data, nil
+}
+
+// MaxZones is the most zones an AVR can have, YNC has Main_Zone and Zone_2 to Zone_4
+const MaxZones = 4
+
+// ZoneElement returns the YNC element name for a zone number (1 is the main zone)
+func ZoneElement(zone int) string {
+	if zone <= 1 {
+		return "Main_Zone"
+	}
+	return fmt.Sprintf("Zone_%d", zone)
+}
+
+// Zones returns how many zones an AVR with features (from its Feature_Existence) has, counting
+// Zone_2, Zone_3 etc. until one is missing, every AVR has at least the main zone
+func Zones(features map[string]bool) int {
+	zones := 1
+	for zone := 2; zone <= MaxZones && features[ZoneElement(zone)]; zone++ {
+		zones = zone
+	}
+	return zones
+}
+
+// ZoneStatus is the state of one zone as read from the AVR
+type ZoneStatus struct {
+	Power        bool
+	Volume       float64 // dB
+	Muted        bool
+	Input        string
+	SoundProgram string // DSP program, blank for zones (or models) that don't have one
+}
+
+// ZoneStatus reads power, volume, mute, input and sound program for a zone in one Basic_Status request
+func (c *Client) ZoneStatus(ctx context.Context, zone int) (ZoneStatus, error) {
+	element := ZoneElement(zone)
+	data, err := c.Request(ctx, "GET", "<"+element+"><Basic_Status>GetParam</Basic_Status></"+element+">")
+	if err != nil {
+		return ZoneStatus{}, err
+	}
+	var rsp struct {
+		Zone struct {
+			Status struct {
+				Power  string `xml:"Power_Control>Power"`
+				Volume struct {
+					Value    int    `xml:"Lvl>Val"`
+					Exponent int    `xml:"Lvl>Exp"`
+					Mute     string `xml:"Mute"`
+				} `xml:"Volume"`
+				Input        string `xml:"Input>Input_Sel"`
+				SoundProgram string `xml:"Surround>Program_Sel>Current>Sound_Program"`
+			} `xml:"Basic_Status"`
+		} `xml:",any"`
+	}
+	if err := xml.Unmarshal(data, &rsp); err != nil {
+		return ZoneStatus{}, err
+	}
+	status := rsp.Zone.Status
+	volume := float64(status.Volume.Value)
+	for i := 0; i < status.Volume.Exponent; i++ {
+		volume /= 10
+	}
+	return ZoneStatus{
+		Power:        status.Power == "On",
+		Volume:       volume,
+		Muted:        status.Volume.Mute == "On",
+		Input:        status.Input,
+		SoundProgram: status.SoundProgram,
+	}, nil
+}
+
+// SystemConfig is what the AVR's System Config says about the model
+type SystemConfig struct {
+	Model    string
+	Firmware string          // the System Config's Version, e.g. 1.80/2.01
+	Features map[string]bool // from Feature_Existence, empty if the AVR doesn't list them
+}
+
+// SystemConfig reads the AVR's System Config
+func (c *Client) SystemConfig(ctx context.Context) (SystemConfig, error) {
+	data, err := c.Request(ctx, "GET", "<System><Config>GetParam</Config></System>")
+	if err != nil {
+		return SystemConfig{}, err
+	}
+	var rsp struct {
+		Config struct {
+			Model    string `xml:"Model_Name"`
+			Version  string `xml:"Version"`
+			Features struct {
+				Elements []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:"Feature_Existence"`
+		} `xml:"System>Config"`
+	}
+	if err := xml.Unmarshal(data, &rsp); err != nil {
+		return SystemConfig{}, err
+	}
+	config := SystemConfig{
+		Model:    strings.TrimSpace(rsp.Config.Model),
+		Firmware: strings.TrimSpace(rsp.Config.Version),
+		Features: make(map[string]bool),
+	}
+	for _, element := range rsp.Config.Features.Elements {
+		config.Features[element.XMLName.Local] = strings.TrimSpace(element.Value) == "1"
+	}
+	return config, nil
+}
+
+// Features reads the Feature_Existence block of the AVR's System Config, mapping each feature
+// (Main_Zone, Zone_2, Tuner, NET_RADIO etc.) to whether the model has it
+func (c *Client) Features(ctx context.Context) (map[string]bool, error) {
+	config, err := c.SystemConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Features) == 0 {
+		return nil, fmt.Errorf("AVR at %s doesn't list its features", c.IP())
+	}
+	return config.Features, nil
+}
+
+// Zones reads how many zones the AVR has, just the main zone if it doesn't list its features
+func (c *Client) Zones(ctx context.Context) int {
+	features, err := c.Features(ctx)
+	if err != nil {
+		return 1
+	}
+	return Zones(features)
+}
+
+// InputNames reads the names of the inputs that can be selected in a zone (Input_Sel_Item),
+// in the order the AVR lists them
+func (c *Client) InputNames(ctx context.Context, zone int) ([]string, error) {
+	element := ZoneElement(zone)
+	data, err := c.Request(ctx, "GET", "<"+element+"><Input><Input_Sel_Item>GetParam</Input_Sel_Item></Input></"+element+">")
+	if err != nil {
+		return nil, err
+	}
+	var rsp struct {
+		Zone struct {
+			Items struct {
+				List []struct {
+					Param string `xml:"Param"`
+				} `xml:",any"`
+			} `xml:"Input>Input_Sel_Item"`
+		} `xml:",any"`
+	}
+	if err := xml.Unmarshal(data, &rsp); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, item := range rsp.Zone.Items.List {
+		if item.Param != "" {
+			names = append(names, item.Param)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("AVR at %s listed no inputs for zone %d", c.IP(), zone)
+	}
+	return names, nil
+}
+
+// SetSoundProgram selects a zone's DSP program (e.g. "Standard", "7ch Stereo"), the names depend on the model
+func (c *Client) SetSoundProgram(ctx context.Context, program string, zone int) error {
+	element := ZoneElement(zone)
+	var escaped strings.Builder
+	if err := xml.EscapeText(&escaped, []byte(program)); err != nil {
+		return err
+	}
+	return Retry(ctx, func() error {
+		_, err := c.Request(ctx, "PUT", "<"+element+"><Surround><Program_Sel><Current><Sound_Program>"+escaped.String()+
+			"</Sound_Program></Current></Program_Sel></Surround></"+element+">")
+		return err
+	})
+}
+
+// TunerBands reads the bands the AVR's tuner can receive (FM, AM, DAB etc.) from the ranges in its
+// Tuner Config, in the order the AVR lists them
+func (c *Client) TunerBands(ctx context.Context) ([]string, error) {
+	data, err := c.Request(ctx, "GET", "<Tuner><Config>GetParam</Config></Tuner>")
+	if err != nil {
+		return nil, err
+	}
+	var rsp struct {
+		Range struct {
+			Bands []struct {
+				XMLName xml.Name
+			} `xml:",any"`
+		} `xml:"Tuner>Config>Range_and_Step>Range"`
+	}
+	if err := xml.Unmarshal(data, &rsp); err != nil {
+		return nil, err
+	}
+	var bands []string
+	for _, band := range rsp.Range.Bands {
+		bands = append(bands, band.XMLName.Local)
+	}
+	if len(bands) == 0 {
+		return nil, fmt.Errorf("AVR at %s listed no tuner bands", c.IP())
+	}
+	return bands, nil
+}
+
+// SetTunerBand switches the tuner to a band (one of TunerBands)
+func (c *Client) SetTunerBand(ctx context.Context, band string) error {
+	var escaped strings.Builder
+	if err := xml.EscapeText(&escaped, []byte(band)); err != nil {
+		return err
+	}
+	return Retry(ctx, func() error {
+		_, err := c.Request(ctx, "PUT", "<Tuner><Play_Control><Tuning><Band>"+escaped.String()+"</Band></Tuning></Play_Control></Tuner>")
+		return err
+	})
+}
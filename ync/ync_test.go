@@ -0,0 +1,107 @@
+package ync_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync/ynctest"
+	"github.com/lindsaymarkward/go-avr-yamaha"
+)
+
+func TestZones(t *testing.T) {
+	tests := []struct {
+		features map[string]bool
+		want     int
+	}{
+		{nil, 1},
+		{map[string]bool{"Main_Zone": true}, 1},
+		{map[string]bool{"Main_Zone": true, "Zone_2": true}, 2},
+		{map[string]bool{"Main_Zone": true, "Zone_2": true, "Zone_3": false, "Zone_4": true}, 2},
+		{map[string]bool{"Main_Zone": true, "Zone_2": true, "Zone_3": true, "Zone_4": true}, 4},
+	}
+	for _, test := range tests {
+		if got := ync.Zones(test.features); got != test.want {
+			t.Errorf("Zones(%v) = %d, want %d", test.features, got, test.want)
+		}
+	}
+}
+
+func TestClientZones(t *testing.T) {
+	avr := ynctest.NewServer()
+	defer avr.Close()
+	client := ync.NewUnqueuedClient(&avryamaha.AVR{IP: avr.IP()}, ync.DefaultTimeout)
+
+	if got := client.Zones(context.Background()); got != 1 {
+		t.Errorf("Zones() = %d with just a main zone, want 1", got)
+	}
+	avr.SetZone(2, ynctest.Zone{})
+	if got := client.Zones(context.Background()); got != 2 {
+		t.Errorf("Zones() = %d with zone 2, want 2", got)
+	}
+	// older AVRs don't list their features, so only the main zone is assumed
+	avr.SetFeatures()
+	if got := client.Zones(context.Background()); got != 1 {
+		t.Errorf("Zones() = %d without features, want 1", got)
+	}
+}
+
+func TestZoneStatus(t *testing.T) {
+	avr := ynctest.NewServer()
+	defer avr.Close()
+	avr.SetZone(2, ynctest.Zone{Power: true, Volume: -35.5, Muted: true, Input: "NET RADIO"})
+	client := ync.NewUnqueuedClient(&avryamaha.AVR{IP: avr.IP()}, ync.DefaultTimeout)
+	ctx := context.Background()
+
+	status, err := client.ZoneStatus(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ync.ZoneStatus{Power: true, Volume: -35.5, Muted: true, Input: "NET RADIO"}
+	if status != want {
+		t.Errorf("ZoneStatus(2) = %+v, want %+v", status, want)
+	}
+
+	if err := client.SetMuted(ctx, false, 2); err != nil {
+		t.Fatal(err)
+	}
+	if avr.Zone(2).Muted {
+		t.Error("zone 2 still muted after SetMuted(false)")
+	}
+
+	avr.Fail(2, true)
+	if _, err := client.ZoneStatus(ctx, 2); err == nil {
+		t.Error("ZoneStatus(2) worked for a failing zone")
+	}
+	if _, err := client.ZoneStatus(ctx, 1); err != nil {
+		t.Errorf("ZoneStatus(1) failed with zone 2 failing: %s", err)
+	}
+}
+
+func TestTunerBands(t *testing.T) {
+	avr := ynctest.NewServer()
+	defer avr.Close()
+	avr.SetTunerBands("FM", "DAB")
+	client := ync.NewUnqueuedClient(&avryamaha.AVR{IP: avr.IP()}, ync.DefaultTimeout)
+	ctx := context.Background()
+
+	bands, err := client.TunerBands(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bands) != 2 || bands[0] != "FM" || bands[1] != "DAB" {
+		t.Errorf("TunerBands() = %v, want [FM DAB]", bands)
+	}
+	if err := client.SetTunerBand(ctx, "DAB"); err != nil {
+		t.Fatal(err)
+	}
+	if got := avr.TunerBand(); got != "DAB" {
+		t.Errorf("band = %s after SetTunerBand(DAB)", got)
+	}
+
+	// without a tuner the AVR has no Tuner Config
+	avr.SetFeatures("NET_RADIO")
+	if bands, err := client.TunerBands(ctx); err == nil {
+		t.Errorf("TunerBands() = %v without a tuner, want an error", bands)
+	}
+}
@@ -0,0 +1,326 @@
+// Package ynctest is a fake AVR that answers YNC requests over HTTP, for testing code that talks to AVRs
+// without one on the network
+// it knows the System Config, the Tuner Config, each zone's Basic_Status and input list, and the PUTs for
+// power, volume, mute, input, DSP program and tuner band, anything else is answered with an error RC like a real AVR
+package ynctest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lindsaymarkward/driver-avr-yamaha/ync"
+)
+
+// rcError is the RC a real AVR answers unknown requests with
+const rcError = "2"
+
+// Zone is the state of one of the fake AVR's zones
+type Zone struct {
+	Power        bool
+	Volume       float64 // dB
+	Muted        bool
+	Input        string
+	SoundProgram string
+}
+
+// a Server is a fake AVR, its IP (host:port) is used in place of a real AVR's address
+type Server struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	model    string
+	firmware string
+	features []string // Feature_Existence elements other than the zones
+	inputs   []string
+	bands    []string // tuner bands, only listed if the features include Tuner
+	band     string
+	zones    map[int]*Zone
+	failing  map[int]bool
+	requests int
+}
+
+// NewServer starts a fake AVR with just a main zone (off, at -40 dB on HDMI1), Close it when done
+func NewServer() *Server {
+	s := &Server{
+		model:    "RX-V671",
+		firmware: "1.80/2.01",
+		features: []string{"Tuner", "NET_RADIO", "USB"},
+		inputs:   []string{"HDMI1", "HDMI2", "AV1", "TUNER", "NET RADIO", "USB"},
+		bands:    []string{"FM", "AM"},
+		band:     "FM",
+		zones:    map[int]*Zone{1: &Zone{Volume: -40, Input: "HDMI1", SoundProgram: "Standard"}},
+		failing:  make(map[int]bool),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// IP returns the fake AVR's address (with its port)
+func (s *Server) IP() string {
+	return strings.TrimPrefix(s.server.URL, "http://")
+}
+
+// SetFeatures replaces the Feature_Existence elements (other than zones, which come from SetZone)
+// the fake AVR lists, none makes it an older AVR that doesn't list them
+func (s *Server) SetFeatures(features ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.features = features
+}
+
+// SetTunerBands replaces the bands the fake AVR's tuner lists in its Tuner Config
+func (s *Server) SetTunerBands(bands ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.bands = bands
+}
+
+// TunerBand returns the band the tuner was last switched to
+func (s *Server) TunerBand() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.band
+}
+
+// SetZone sets a zone's state, adding the zone if it's new
+func (s *Server) SetZone(zone int, state Zone) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.zones[zone] = &state
+}
+
+// Zone returns a zone's state
+func (s *Server) Zone(zone int) Zone {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if z, ok := s.zones[zone]; ok {
+		return *z
+	}
+	return Zone{}
+}
+
+// Fail makes every request for a zone fail (or work again)
+func (s *Server) Fail(zone int, fail bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failing[zone] = fail
+}
+
+// Requests returns how many requests the fake AVR has answered
+func (s *Server) Requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
+
+// an element is any element of a YNC request
+type element struct {
+	XMLName  xml.Name
+	Cmd      string    `xml:"cmd,attr"`
+	Text     string    `xml:",chardata"`
+	Children []element `xml:",any"`
+}
+
+// child returns the element at path below e
+func (e element) child(path ...string) (element, bool) {
+	for _, name := range path {
+		found := false
+		for _, c := range e.Children {
+			if c.XMLName.Local == name {
+				e, found = c, true
+				break
+			}
+		}
+		if !found {
+			return element{}, false
+		}
+	}
+	return e, true
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests++
+
+	body, _ := ioutil.ReadAll(r.Body)
+	var root element
+	if r.URL.Path != "/YamahaRemoteControl/ctrl" || xml.Unmarshal(body, &root) != nil || len(root.Children) != 1 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	target := root.Children[0]
+	inner, rc := "", rcError
+	switch {
+	case target.XMLName.Local == "System" && root.Cmd == "GET":
+		if _, ok := target.child("Config"); ok {
+			inner, rc = "<System>"+s.systemConfig()+"</System>", "0"
+		}
+	case target.XMLName.Local == "Tuner" && s.hasFeature("Tuner"):
+		var reply string
+		reply, rc = s.tunerRequest(root.Cmd, target)
+		inner = "<Tuner>" + reply + "</Tuner>"
+	default:
+		if zone, ok := s.zoneNumber(target.XMLName.Local); ok && !s.failing[zone] {
+			var reply string
+			reply, rc = s.zoneRequest(root.Cmd, s.zones[zone], target)
+			inner = "<" + target.XMLName.Local + ">" + reply + "</" + target.XMLName.Local + ">"
+		}
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><YAMAHA_AV rsp="%s" RC="%s">%s</YAMAHA_AV>`, root.Cmd, rc, inner)
+}
+
+// zoneNumber returns the zone a Main_Zone or Zone_N element is for, if the fake AVR has it
+func (s *Server) zoneNumber(name string) (int, bool) {
+	for zone := range s.zones {
+		if ync.ZoneElement(zone) == name {
+			return zone, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) hasFeature(feature string) bool {
+	for _, f := range s.features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// tunerRequest answers a GET of the Tuner Config or a PUT of the band, returning the reply inside the
+// Tuner element and the RC
+func (s *Server) tunerRequest(cmd string, target element) (string, string) {
+	if _, ok := target.child("Config"); ok && cmd == "GET" {
+		ranges, steps := "", ""
+		for _, band := range s.bands {
+			ranges += "<" + band + "><Min>0</Min><Max>0</Max><Unit></Unit></" + band + ">"
+			steps += "<" + band + "><Val>0</Val><Unit></Unit></" + band + ">"
+		}
+		return "<Config><Feature_Availability>Ready</Feature_Availability><Range_and_Step><Range>" + ranges +
+			"</Range><Step>" + steps + "</Step></Range_and_Step></Config>", "0"
+	}
+	if band, ok := target.child("Play_Control", "Tuning", "Band"); ok && cmd == "PUT" {
+		for _, b := range s.bands {
+			if b == band.Text {
+				s.band = b
+				return "", "0"
+			}
+		}
+	}
+	return "", rcError
+}
+
+func (s *Server) systemConfig() string {
+	features := ""
+	for _, feature := range s.features {
+		features += "<" + feature + ">1</" + feature + ">"
+	}
+	if len(s.features) > 0 {
+		for zone := 1; zone <= ync.MaxZones; zone++ {
+			if _, ok := s.zones[zone]; ok {
+				features += "<" + ync.ZoneElement(zone) + ">1</" + ync.ZoneElement(zone) + ">"
+			}
+		}
+	}
+	return "<Config><Model_Name>" + s.model + "</Model_Name><System_ID>0123ABCD</System_ID><Version>" + s.firmware +
+		"</Version><Feature_Existence>" + features + "</Feature_Existence></Config>"
+}
+
+// zoneRequest answers a GET or PUT for a zone, returning the reply inside the zone element and the RC
+func (s *Server) zoneRequest(cmd string, zone *Zone, target element) (string, string) {
+	if cmd == "GET" {
+		if _, ok := target.child("Basic_Status"); ok {
+			return basicStatus(zone), "0"
+		}
+		if _, ok := target.child("Input", "Input_Sel_Item"); ok {
+			items := ""
+			for i, input := range s.inputs {
+				items += fmt.Sprintf("<Item_%d><Param>%s</Param><RW>RW</RW></Item_%d>", i+1, escape(input), i+1)
+			}
+			return "<Input><Input_Sel_Item>" + items + "</Input_Sel_Item></Input>", "0"
+		}
+		return "", rcError
+	}
+	if cmd != "PUT" {
+		return "", rcError
+	}
+	if power, ok := target.child("Power_Control", "Power"); ok {
+		switch power.Text {
+		case "On", "Standby":
+			zone.Power = power.Text == "On"
+		case "On/Standby":
+			zone.Power = !zone.Power
+		default:
+			return "", rcError
+		}
+		return "", "0"
+	}
+	if mute, ok := target.child("Volume", "Mute"); ok {
+		switch mute.Text {
+		case "On", "Off":
+			zone.Muted = mute.Text == "On"
+		case "On/Off":
+			zone.Muted = !zone.Muted
+		default:
+			return "", rcError
+		}
+		return "", "0"
+	}
+	if level, ok := target.child("Volume", "Lvl"); ok {
+		val, _ := level.child("Val")
+		exp, _ := level.child("Exp")
+		value, err := strconv.Atoi(val.Text)
+		exponent, err2 := strconv.Atoi(exp.Text)
+		if err != nil || err2 != nil {
+			return "", rcError
+		}
+		zone.Volume = float64(value) / math.Pow(10, float64(exponent))
+		return "", "0"
+	}
+	if input, ok := target.child("Input", "Input_Sel"); ok {
+		zone.Input = input.Text
+		return "", "0"
+	}
+	if program, ok := target.child("Surround", "Program_Sel", "Current", "Sound_Program"); ok {
+		zone.SoundProgram = program.Text
+		return "", "0"
+	}
+	return "", rcError
+}
+
+// basicStatus is a zone's Basic_Status as a real AVR sends it (volume in tenths of a dB)
+func basicStatus(zone *Zone) string {
+	power, mute := "Standby", "Off"
+	if zone.Power {
+		power = "On"
+	}
+	if zone.Muted {
+		mute = "On"
+	}
+	return fmt.Sprintf("<Basic_Status><Power_Control><Power>%s</Power></Power_Control>"+
+		"<Volume><Lvl><Val>%d</Val><Exp>1</Exp><Unit>dB</Unit></Lvl><Mute>%s</Mute></Volume>"+
+		"<Input><Input_Sel>%s</Input_Sel></Input>"+
+		"<Surround><Program_Sel><Current><Straight>Off</Straight><Sound_Program>%s</Sound_Program></Current></Program_Sel></Surround>"+
+		"</Basic_Status>", power, int(math.Round(zone.Volume*10)), mute, escape(zone.Input), escape(zone.SoundProgram))
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}